@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor"
+)
+
+var errQueueFull = errors.New("too many calls are waiting to run")
+
+var priorities = map[string]int{
+	"high":   0,
+	"normal": 1,
+	"low":    2,
+}
+
+func validPriority(priority string) error {
+	if _, ok := priorities[priority]; !ok && priority != "" {
+		return fmt.Errorf("unknown priority: %s", priority)
+	}
+	return nil
+}
+
+type admissionEntry struct {
+	Function   string                     `json:"function"`
+	Priority   string                     `json:"priority"`
+	Request    receptor.TaskCreateRequest `json:"request"`
+	EnqueuedAt time.Time                  `json:"enqueued_at"`
+}
+
+func (entry *admissionEntry) rank() int {
+	if rank, ok := priorities[entry.Priority]; ok {
+		return rank
+	}
+	return priorities["normal"]
+}
+
+type admissionQueue []*admissionEntry
+
+func (q admissionQueue) Len() int      { return len(q) }
+func (q admissionQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q admissionQueue) Less(i, j int) bool {
+	if q[i].rank() != q[j].rank() {
+		return q[i].rank() < q[j].rank()
+	}
+	return q[i].EnqueuedAt.Before(q[j].EnqueuedAt)
+}
+
+func admissionPath(guid string) string {
+	return filepath.Join("queue", guid+".json")
+}
+
+// admissionController caps the number of tasks gamma has in flight, both
+// overall and per function. Calls over the cap wait in a priority queue and
+// are submitted as completion callbacks free up room.
+type admissionController struct {
+	sync.Mutex
+	maxInFlight int
+	maxQueued   int
+	total       int
+	inFlight    map[string]int
+	tasks       map[string]string
+	queue       admissionQueue
+	admitted    int
+	waited      time.Duration
+}
+
+var admission = &admissionController{
+	maxQueued: 1000,
+	inFlight:  map[string]int{},
+	tasks:     map[string]string{},
+}
+
+type AdmissionStats struct {
+	InFlight           int                                `json:"in_flight"`
+	MaxInFlight        int                                `json:"max_in_flight"`
+	Queued             int                                `json:"queued"`
+	MaxQueued          int                                `json:"max_queued"`
+	QueuedByPriority   map[string]int                     `json:"queued_by_priority"`
+	OldestWaitSeconds  float64                            `json:"oldest_wait_seconds"`
+	AverageWaitSeconds float64                            `json:"average_wait_seconds"`
+	Functions          map[string]*FunctionAdmissionStats `json:"functions"`
+}
+
+type FunctionAdmissionStats struct {
+	InFlight    int `json:"in_flight"`
+	MaxInFlight int `json:"max_in_flight"`
+	Queued      int `json:"queued"`
+}
+
+func (a *admissionController) load() error {
+	a.Lock()
+	err := loadJSONDir("queue", func(path string) error {
+		entry := &admissionEntry{}
+		if err := loadJSON(path, entry); err != nil {
+			return err
+		}
+		a.queue = append(a.queue, entry)
+		return nil
+	})
+	sort.Sort(a.queue)
+
+	tasks, terr := client.TasksByDomain("gamma")
+	if terr != nil {
+		log.Println("failed to count tasks in flight:", terr)
+	}
+	for _, task := range tasks {
+		if task.State == receptor.TaskStateCompleted || task.State == receptor.TaskStateResolving {
+			continue
+		}
+		function := admissionKey(task.Annotation)
+		a.tasks[task.TaskGuid] = function
+		a.inFlight[function]++
+		a.total++
+	}
+	a.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	a.dispatch()
+	return nil
+}
+
+func admissionKey(annotation string) string {
+	var a taskAnnotation
+	json.Unmarshal([]byte(annotation), &a)
+	if a.Workflow != "" {
+		return "workflow:" + a.Workflow
+	}
+	return a.Function
+}
+
+func (a *admissionController) hasRoom(function string) bool {
+	if a.maxInFlight > 0 && a.total >= a.maxInFlight {
+		return false
+	}
+	limit := configs.get(function).MaxInFlight
+	return limit == 0 || a.inFlight[function] < limit
+}
+
+func (a *admissionController) reserve(function, guid string) {
+	a.total++
+	a.inFlight[function]++
+	a.tasks[guid] = function
+}
+
+func (a *admissionController) unreserve(guid string) {
+	function, ok := a.tasks[guid]
+	if !ok {
+		return
+	}
+	delete(a.tasks, guid)
+	a.total--
+	a.inFlight[function]--
+	if a.inFlight[function] == 0 {
+		delete(a.inFlight, function)
+	}
+}
+
+// submit runs request straight away if there is room for it, and queues it
+// otherwise. It reports whether the request was queued.
+func (a *admissionController) submit(function, priority string, request receptor.TaskCreateRequest) (bool, error) {
+	a.Lock()
+	if a.hasRoom(function) {
+		a.reserve(function, request.TaskGuid)
+		a.Unlock()
+
+		if err := runTask(request); err != nil {
+			a.Lock()
+			a.unreserve(request.TaskGuid)
+			a.Unlock()
+			return false, err
+		}
+		return false, nil
+	}
+	defer a.Unlock()
+
+	if len(a.queue) >= a.maxQueued {
+		return false, errQueueFull
+	}
+
+	entry := &admissionEntry{
+		Function:   function,
+		Priority:   priority,
+		Request:    request,
+		EnqueuedAt: time.Now(),
+	}
+	if err := saveJSON(admissionPath(request.TaskGuid), entry); err != nil {
+		return false, err
+	}
+
+	a.queue = append(a.queue, entry)
+	sort.Sort(a.queue)
+
+	return true, nil
+}
+
+func (a *admissionController) isQueued(guid string) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	for _, entry := range a.queue {
+		if entry.Request.TaskGuid == guid {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *admissionController) queued(function string) int {
+	a.Lock()
+	defer a.Unlock()
+
+	count := 0
+	for _, entry := range a.queue {
+		if entry.Function == function {
+			count++
+		}
+	}
+	return count
+}
+
+func (a *admissionController) taskCompleted(task receptor.TaskResponse) {
+	a.Lock()
+	a.unreserve(task.TaskGuid)
+	a.Unlock()
+
+	a.dispatch()
+}
+
+// dispatch submits queued requests in priority order for as long as there is
+// room. A function at its own limit does not hold up the functions queued
+// behind it.
+func (a *admissionController) dispatch() {
+	a.Lock()
+	var ready []*admissionEntry
+	remaining := admissionQueue{}
+	for _, entry := range a.queue {
+		if a.hasRoom(entry.Function) {
+			a.reserve(entry.Function, entry.Request.TaskGuid)
+			a.admitted++
+			a.waited += time.Since(entry.EnqueuedAt)
+			ready = append(ready, entry)
+		} else {
+			remaining = append(remaining, entry)
+		}
+	}
+	a.queue = remaining
+	a.Unlock()
+
+	for _, entry := range ready {
+		err := runTask(entry.Request)
+		if err := os.Remove(admissionPath(entry.Request.TaskGuid)); err != nil {
+			log.Println("failed to remove queued call:", err)
+		}
+		if err != nil {
+			// The call was accepted long ago, so it is completed as failed
+			// for everything waiting on it, which also frees its room.
+			log.Println("failed to submit queued call:", entry.Request.TaskGuid, err)
+			taskCompleted(failedTask(entry.Request, err.Error()))
+		}
+	}
+}
+
+func (a *admissionController) stats() AdmissionStats {
+	a.Lock()
+	defer a.Unlock()
+
+	stats := AdmissionStats{
+		InFlight:         a.total,
+		MaxInFlight:      a.maxInFlight,
+		Queued:           len(a.queue),
+		MaxQueued:        a.maxQueued,
+		QueuedByPriority: map[string]int{},
+		Functions:        map[string]*FunctionAdmissionStats{},
+	}
+	for priority := range priorities {
+		stats.QueuedByPriority[priority] = 0
+	}
+
+	function := func(name string) *FunctionAdmissionStats {
+		if _, ok := stats.Functions[name]; !ok {
+			stats.Functions[name] = &FunctionAdmissionStats{
+				MaxInFlight: configs.get(name).MaxInFlight,
+			}
+		}
+		return stats.Functions[name]
+	}
+
+	for name, count := range a.inFlight {
+		function(name).InFlight = count
+	}
+
+	for _, entry := range a.queue {
+		priority := entry.Priority
+		if priority == "" {
+			priority = "normal"
+		}
+		stats.QueuedByPriority[priority]++
+		function(entry.Function).Queued++
+
+		if wait := time.Since(entry.EnqueuedAt).Seconds(); wait > stats.OldestWaitSeconds {
+			stats.OldestWaitSeconds = wait
+		}
+	}
+
+	if a.admitted > 0 {
+		stats.AverageWaitSeconds = a.waited.Seconds() / float64(a.admitted)
+	}
+
+	return stats
+}
+
+func admissionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, admission.stats())
+}
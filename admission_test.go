@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/cloudfoundry-incubator/receptor"
+)
+
+type testSubmission struct {
+	function string
+	priority string
+	guid     string
+}
+
+func submitTest(t *testing.T, submission testSubmission) bool {
+	queued, err := admission.submit(submission.function, submission.priority, testRequest(submission.function, submission.guid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queued
+}
+
+func TestAdmissionDispatchOrder(t *testing.T) {
+	defer func() { configs = &configStore{configs: map[string]FunctionConfig{}} }()
+	configs.set("limited", FunctionConfig{MaxInFlight: 1})
+
+	for _, test := range []struct {
+		name        string
+		maxInFlight int
+		running     []testSubmission
+		queued      []testSubmission
+		dispatched  []string
+	}{
+		{
+			name:        "dispatches by priority",
+			maxInFlight: 1,
+			running:     []testSubmission{{"fn", "", "running"}},
+			queued: []testSubmission{
+				{"fn", "low", "low"},
+				{"fn", "", "normal"},
+				{"fn", "high", "high"},
+			},
+			dispatched: []string{"high", "normal", "low"},
+		},
+		{
+			name:        "passes over a function at its own limit",
+			maxInFlight: 2,
+			running:     []testSubmission{{"limited", "", "limited-1"}, {"fn", "", "running"}},
+			queued: []testSubmission{
+				{"limited", "high", "limited-2"},
+				{"fn", "low", "other"},
+			},
+			dispatched: []string{"other"},
+		},
+	} {
+		fake := useFakeReceptor()
+		admission.maxInFlight = test.maxInFlight
+
+		for _, submission := range test.running {
+			if submitTest(t, submission) {
+				t.Fatalf("%s: %s was queued", test.name, submission.guid)
+			}
+		}
+		for _, submission := range test.queued {
+			if !submitTest(t, submission) {
+				t.Fatalf("%s: %s was not queued", test.name, submission.guid)
+			}
+		}
+
+		// Complete each task as it is dispatched, starting with the one
+		// that was running, to see the order the queue drains in.
+		started := len(test.running)
+		dispatched := []string{}
+		for next := "running"; ; {
+			admission.taskCompleted(receptor.TaskResponse{TaskGuid: next})
+			guids := fake.createdGuids()
+			if len(guids) == started+len(dispatched) {
+				break
+			}
+			next = guids[len(guids)-1]
+			dispatched = append(dispatched, next)
+		}
+
+		if !reflect.DeepEqual(dispatched, test.dispatched) {
+			t.Errorf("%s: dispatched %v, expected %v", test.name, dispatched, test.dispatched)
+		}
+	}
+}
+
+func TestAdmissionFailedDispatchCompletesCall(t *testing.T) {
+	fake := useFakeReceptor()
+	admission.maxInFlight = 1
+
+	submitTest(t, testSubmission{"fn", "", "running"})
+	for _, guid := range []string{"queued-1", "queued-2"} {
+		submitTest(t, testSubmission{"fn", "", guid})
+		history.submitted(guid, "fn", FunctionCall{}, callStatusQueued)
+	}
+
+	fake.createErr = func(string) error { return errors.New("receptor is down") }
+	admission.taskCompleted(receptor.TaskResponse{TaskGuid: "running"})
+
+	stats := admission.stats()
+	if stats.InFlight != 0 || stats.Queued != 0 {
+		t.Errorf("%d in flight and %d queued after failed dispatches", stats.InFlight, stats.Queued)
+	}
+	for _, guid := range []string{"queued-1", "queued-2"} {
+		if record, _ := history.get(guid); record.Status != callStatusFailed {
+			t.Errorf("%s is %s, expected %s", guid, record.Status, callStatusFailed)
+		}
+		if _, err := os.Stat(admissionPath(guid)); !os.IsNotExist(err) {
+			t.Errorf("%s is still saved in the queue", guid)
+		}
+	}
+}
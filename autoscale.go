@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor"
+)
+
+// AutoscaleConfig lets gamma size a warm pool between MinInstances and
+// MaxInstances, aiming to keep TargetBusyRatio of running instances busy.
+// With ScaleToZeroAfter set, a pool that has had no calls for that long is
+// scaled down to nothing, and calls run as tasks until it comes back.
+type AutoscaleConfig struct {
+	MinInstances     int     `json:"min_instances"`
+	MaxInstances     int     `json:"max_instances"`
+	TargetBusyRatio  float64 `json:"target_busy_ratio,omitempty"`
+	Cooldown         string  `json:"cooldown,omitempty"`
+	ScaleToZeroAfter string  `json:"scale_to_zero_after,omitempty"`
+
+	cooldown         time.Duration
+	scaleToZeroAfter time.Duration
+}
+
+func (config *AutoscaleConfig) validate() error {
+	if config.MinInstances < 0 {
+		return errors.New("min_instances must not be negative")
+	}
+	if config.MaxInstances < 1 || config.MaxInstances < config.MinInstances {
+		return errors.New("max_instances must be at least 1 and at least min_instances")
+	}
+	if config.TargetBusyRatio == 0 {
+		config.TargetBusyRatio = 0.7
+	}
+	if config.TargetBusyRatio < 0 || config.TargetBusyRatio > 1 {
+		return errors.New("target_busy_ratio must be between 0 and 1")
+	}
+
+	if config.Cooldown == "" {
+		config.Cooldown = "1m"
+	}
+	cooldown, err := time.ParseDuration(config.Cooldown)
+	if err != nil || cooldown < 0 {
+		return fmt.Errorf("invalid cooldown: %s", config.Cooldown)
+	}
+	config.cooldown = cooldown
+
+	if config.ScaleToZeroAfter != "" {
+		idle, err := time.ParseDuration(config.ScaleToZeroAfter)
+		if err != nil || idle <= 0 {
+			return fmt.Errorf("invalid scale_to_zero_after: %s", config.ScaleToZeroAfter)
+		}
+		config.scaleToZeroAfter = idle
+	}
+
+	return nil
+}
+
+// ScalingDecision records why the autoscaler changed a warm pool, so that
+// operators can see what it did after the fact.
+type ScalingDecision struct {
+	Time      time.Time `json:"time"`
+	Function  string    `json:"function"`
+	From      int       `json:"from"`
+	To        int       `json:"to"`
+	Reason    string    `json:"reason"`
+	CallRate  float64   `json:"call_rate"`
+	Queued    int       `json:"queued"`
+	Busy      int       `json:"busy"`
+	Running   int       `json:"running"`
+	BusyRatio float64   `json:"busy_ratio"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func scalingLogPath(name string) string {
+	return filepath.Join("scaling", name+".jsonl")
+}
+
+type autoscaler struct {
+	sync.Mutex
+	interval   time.Duration
+	startedAt  time.Time
+	lastChange map[string]time.Time
+}
+
+var autoscale = &autoscaler{
+	interval:   10 * time.Second,
+	startedAt:  time.Now(),
+	lastChange: map[string]time.Time{},
+}
+
+func (a *autoscaler) run() {
+	for now := range time.Tick(a.interval) {
+		pooled := map[string]WarmPoolConfig{}
+		for name, config := range configs.list() {
+			if config.WarmPool != nil && config.WarmPool.Autoscale != nil {
+				pooled[name] = *config.WarmPool
+			}
+		}
+
+		for name, config := range pooled {
+			a.evaluate(name, *config.Autoscale, now)
+		}
+	}
+}
+
+// evaluate samples the function's call rate, queue depth and busy ratio, and
+// rescales its warm pool if they call for it.
+func (a *autoscaler) evaluate(name string, config AutoscaleConfig, now time.Time) {
+	config.validate()
+
+	calls, lastCall, busy := pools.usage(name)
+
+	desired, err := client.GetDesiredLRP(processGuid(name))
+	if err != nil {
+		log.Println("autoscaler failed to look up warm pool:", name, err)
+		return
+	}
+	actuals, err := client.ActualLRPsByProcessGuid(processGuid(name))
+	if err != nil {
+		log.Println("autoscaler failed to look up warm pool:", name, err)
+		return
+	}
+
+	decision := ScalingDecision{
+		Time:     now,
+		Function: name,
+		From:     desired.Instances,
+		CallRate: float64(calls) / a.interval.Seconds(),
+		Queued:   admission.queued(name),
+		Busy:     busy,
+	}
+	for _, actual := range actuals {
+		if actual.State == receptor.ActualLRPStateRunning {
+			decision.Running++
+		}
+	}
+	if decision.Running > 0 {
+		decision.BusyRatio = float64(busy) / float64(decision.Running)
+	}
+
+	if lastCall.IsZero() {
+		lastCall = a.startedAt
+	}
+	idle := config.scaleToZeroAfter > 0 && calls == 0 && decision.Queued == 0 && busy == 0 &&
+		now.Sub(lastCall) >= config.scaleToZeroAfter
+
+	floor := config.MinInstances
+	if floor == 0 && !idle {
+		floor = 1
+	}
+
+	to := decision.From
+	switch {
+	case idle && config.MinInstances == 0:
+		to, decision.Reason = 0, "idle for "+config.ScaleToZeroAfter
+	case decision.From == 0 && (calls > 0 || decision.Queued > 0):
+		to, decision.Reason = 1, "calls arrived while scaled to zero"
+	case decision.BusyRatio >= config.TargetBusyRatio || decision.Queued > 0:
+		to = int(math.Ceil(float64(busy+decision.Queued) / config.TargetBusyRatio))
+		if to <= decision.From {
+			to = decision.From + 1
+		}
+		decision.Reason = "busy ratio or queue above target"
+	case decision.Running == decision.From && decision.BusyRatio < config.TargetBusyRatio/2:
+		to, decision.Reason = decision.From-1, "busy ratio well below target"
+	}
+
+	if to < floor {
+		to = floor
+	}
+	if to > config.MaxInstances {
+		to = config.MaxInstances
+	}
+	if to == decision.From {
+		return
+	}
+	if decision.Reason == "" {
+		decision.Reason = "outside configured bounds"
+	}
+
+	a.Lock()
+	lastChange := a.lastChange[name]
+	a.Unlock()
+	if now.Sub(lastChange) < config.cooldown && decision.From != 0 {
+		return
+	}
+
+	decision.To = to
+	if err := client.UpdateDesiredLRP(processGuid(name), receptor.DesiredLRPUpdateRequest{
+		Instances: &to,
+	}); err != nil {
+		log.Println("autoscaler failed to scale warm pool:", name, err)
+		decision.Error = err.Error()
+	} else {
+		a.Lock()
+		a.lastChange[name] = now
+		a.Unlock()
+	}
+
+	if err := a.record(decision); err != nil {
+		log.Println("failed to record scaling decision:", err)
+	}
+}
+
+func (a *autoscaler) record(decision ScalingDecision) error {
+	a.Lock()
+	defer a.Unlock()
+
+	file, err := os.OpenFile(scalingLogPath(decision.Function), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewEncoder(file).Encode(decision)
+}
+
+// decisions returns up to limit of the function's most recent scaling
+// decisions, oldest first.
+func (a *autoscaler) decisions(name string, limit int) ([]ScalingDecision, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	decisions := []ScalingDecision{}
+
+	file, err := os.Open(scalingLogPath(name))
+	if os.IsNotExist(err) {
+		return decisions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var decision ScalingDecision
+		if err := json.Unmarshal(scanner.Bytes(), &decision); err != nil {
+			return nil, err
+		}
+		decisions = append(decisions, decision)
+		if len(decisions) > limit {
+			decisions = decisions[1:]
+		}
+	}
+
+	return decisions, scanner.Err()
+}
+
+func scalingHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	limit := 100
+	if param := r.URL.Query().Get("limit"); param != "" {
+		var err error
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	decisions, err := autoscale.decisions(name, limit)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "could not read scaling decisions", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, decisions)
+}
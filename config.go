@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/cloudfoundry-incubator/runtime-schema/models"
+)
+
+type FunctionConfig struct {
+	Runtime        string                       `json:"runtime,omitempty"`
+	NodeVersion    string                       `json:"node_version,omitempty"`
+	Entrypoints    []string                     `json:"entrypoints,omitempty"`
+	Image          string                       `json:"image,omitempty"`
+	Command        string                       `json:"command,omitempty"`
+	Type           string                       `json:"type,omitempty"`
+	MaxInFlight    int                          `json:"max_in_flight,omitempty"`
+	WarmPool       *WarmPoolConfig              `json:"warm_pool,omitempty"`
+	HTTP           *HTTPConfig                  `json:"http,omitempty"`
+	Env            []models.EnvironmentVariable `json:"env,omitempty"`
+	Secrets        []SecretRef                  `json:"secrets,omitempty"`
+	SecretDelivery string                       `json:"secret_delivery,omitempty"`
+	Services       []ServiceBinding             `json:"services,omitempty"`
+	ServiceFormat  string                       `json:"service_format,omitempty"`
+	Privileged     bool                         `json:"privileged,omitempty"`
+	ResourceLimits *models.ResourceLimits       `json:"resource_limits,omitempty"`
+	Stack          string                       `json:"stack,omitempty"`
+	History        *HistoryConfig               `json:"history,omitempty"`
+	Version        string                       `json:"version,omitempty"`
+}
+
+func (config FunctionConfig) validate() error {
+	if err := validRuntime(config.Runtime); err != nil {
+		return err
+	}
+	if config.Image != "" {
+		if err := validImage(config.Image); err != nil {
+			return err
+		}
+	}
+	if config.Command != "" && config.Image == "" {
+		return errors.New("a command needs an image")
+	}
+	if err := validFunctionType(config.Type); err != nil {
+		return err
+	}
+	if config.MaxInFlight < 0 {
+		return errors.New("max_in_flight must not be negative")
+	}
+	if config.WarmPool != nil && (config.Command != "" || config.Runtime != "" && config.Runtime != defaultRuntime) {
+		return errWarmPoolRuntime
+	}
+	if config.Type == functionTypeHTTP && config.WarmPool != nil {
+		return errors.New("http functions cannot have a warm pool")
+	}
+	if config.Type != functionTypeHTTP && config.HTTP != nil {
+		return errors.New("only http functions can have http config")
+	}
+	if config.HTTP != nil && config.HTTP.Instances < 0 {
+		return errors.New("http instances must not be negative")
+	}
+	if config.Type == functionTypeHTTP && config.SecretDelivery == secretDeliveryFile {
+		return errors.New("http functions cannot have their secrets delivered in a file")
+	}
+	if err := validSecretDelivery(config.SecretDelivery); err != nil {
+		return err
+	}
+	if err := validEnv(config.Env); err != nil {
+		return err
+	}
+	if err := validServiceFormat(config.ServiceFormat); err != nil {
+		return err
+	}
+	if err := validResourceLimits(config.ResourceLimits); err != nil {
+		return err
+	}
+	for _, binding := range config.Services {
+		if binding.Service == "" {
+			return errors.New("services need a service name")
+		}
+		if err := validEnv([]models.EnvironmentVariable{{Name: binding.prefix()}}); err != nil {
+			return err
+		}
+	}
+	for _, ref := range config.Secrets {
+		if ref.Secret == "" {
+			return errors.New("secrets need a secret")
+		}
+		if err := validEnv([]models.EnvironmentVariable{{Name: ref.Env}}); err != nil {
+			return err
+		}
+		if ref.Version < 0 {
+			return errors.New("secret versions must not be negative")
+		}
+	}
+	if config.History != nil {
+		if err := config.History.validate(); err != nil {
+			return err
+		}
+	}
+	if config.WarmPool != nil {
+		return config.WarmPool.validate()
+	}
+	return nil
+}
+
+func configPath(name string) string {
+	return filepath.Join("configs", name+".json")
+}
+
+type configStore struct {
+	sync.Mutex
+	configs map[string]FunctionConfig
+}
+
+var configs = &configStore{
+	configs: map[string]FunctionConfig{},
+}
+
+func (s *configStore) load() error {
+	s.Lock()
+	defer s.Unlock()
+
+	return loadJSONDir("configs", func(path string) error {
+		var config FunctionConfig
+		if err := loadJSON(path, &config); err != nil {
+			return err
+		}
+		s.configs[strings.TrimSuffix(filepath.Base(path), ".json")] = config
+		return nil
+	})
+}
+
+func (s *configStore) get(name string) FunctionConfig {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.configs[name]
+}
+
+// list returns a copy of every function's config.
+func (s *configStore) list() map[string]FunctionConfig {
+	s.Lock()
+	defer s.Unlock()
+
+	list := make(map[string]FunctionConfig, len(s.configs))
+	for name, config := range s.configs {
+		list[name] = config
+	}
+	return list
+}
+
+func (s *configStore) set(name string, config FunctionConfig) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := saveJSON(configPath(name), config); err != nil {
+		return err
+	}
+	s.configs[name] = config
+
+	return nil
+}
+
+func getFunctionConfigHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	if err := statFunction(name); err != nil {
+		http.Error(w, "could not find function", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, configs.get(name))
+}
+
+func putFunctionConfigHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	if err := statFunction(name); err != nil {
+		http.Error(w, "could not find function", http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var config FunctionConfig
+	if err := json.Unmarshal(body, &config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Leaving image, command or privileged out keeps the current setting,
+	// while an empty image or command clears it. Only changing privileged
+	// needs an admin.
+	var given struct {
+		Image      *string `json:"image"`
+		Command    *string `json:"command"`
+		Privileged *bool   `json:"privileged"`
+	}
+	json.Unmarshal(body, &given)
+
+	old := configs.get(name)
+	if config.Runtime == "" {
+		config.Runtime = old.Runtime
+	}
+	if given.Image == nil {
+		config.Image = old.Image
+	}
+	if given.Command == nil {
+		config.Command = old.Command
+	}
+	if config.Command == "" && old.Command != "" {
+		if _, err := os.Stat(functionPath(name)); err != nil {
+			http.Error(w, "a function without a tarball needs a command", http.StatusBadRequest)
+			return
+		}
+	}
+	config.NodeVersion = old.NodeVersion
+	config.Entrypoints = old.Entrypoints
+	config.Version = old.Version
+	if given.Privileged == nil {
+		config.Privileged = old.Privileged
+	} else if config.Privileged != old.Privileged && !isAdmin(r) {
+		http.Error(w, errAdminOnly.Error(), http.StatusForbidden)
+		return
+	}
+
+	if err := config.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := cells.checkStack(stackOf(config)); err != nil {
+		http.Error(w, err.Error(), stackErrorStatus(err))
+		return
+	}
+	if err := checkRoutes(name, config); err != nil {
+		http.Error(w, err.Error(), routeErrorStatus(err))
+		return
+	}
+
+	for _, ref := range config.Secrets {
+		if !secrets.exists(ref) {
+			http.Error(w, "could not find secret: "+ref.Secret, http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, binding := range config.Services {
+		if _, err := boundService(binding.Service); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := configs.set(name, config); err != nil {
+		log.Println(err)
+		http.Error(w, "could not save function config", http.StatusInternalServerError)
+		return
+	}
+
+	// Long-running processes have to be replaced to change their privilege,
+	// limits, stack or env.
+	replace := config.Privileged != old.Privileged || config.nofile() != old.nofile() || config.Stack != old.Stack ||
+		!reflect.DeepEqual(config.Env, old.Env) || !reflect.DeepEqual(config.Secrets, old.Secrets) ||
+		!reflect.DeepEqual(config.Services, old.Services) || config.ServiceFormat != old.ServiceFormat
+	if err := deployFunction(name, old, config, replace); err != nil {
+		log.Println(err)
+		http.Error(w, "could not update function's processes: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	writeJSON(w, config)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{
+		"* * * * *",
+		"*/15 9-17 * * mon-fri",
+		"0 0 1,15 * *",
+		"30 4 * jan,JUL 0",
+		"0 0 * * 7",
+		"5-55/10 * * * *",
+		"@hourly",
+		"@yearly",
+	} {
+		if _, err := parseCron(expr); err != nil {
+			t.Errorf("parseCron(%q): %s", expr, err)
+		}
+	}
+
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"* * * foo *",
+		"@fortnightly",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q): expected an error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2015, time.March, 14, 10, 29, 30, 0, time.UTC)
+
+	for _, test := range []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2015, time.March, 14, 10, 30, 0, 0, time.UTC)},
+		{"0 * * * *", time.Date(2015, time.March, 14, 11, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2015, time.March, 14, 10, 40, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2015, time.March, 15, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * mon-fri", time.Date(2015, time.March, 16, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2015, time.March, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2015, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2015, time.March, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2016, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// With both day fields restricted, either of them matches.
+		{"0 0 20 * mon", time.Date(2015, time.March, 16, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2015, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		schedule, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %s", test.expr, err)
+			continue
+		}
+		if next := schedule.next(from); !next.Equal(test.next) {
+			t.Errorf("next(%q) = %s, expected %s", test.expr, next, test.next)
+		}
+	}
+}
+
+func TestSchedulePrepareRejectsNeverMatchingCron(t *testing.T) {
+	for _, expr := range []string{"0 0 31 2 *", "0 0 31 apr,jun,sep,nov *"} {
+		s := Schedule{Function: "hello", Cron: expr}
+		if err := s.prepare(); err == nil {
+			t.Errorf("prepare(%q): expected an error", expr)
+		}
+	}
+
+	s := Schedule{Function: "hello", Cron: "0 0 29 2 *"}
+	if err := s.prepare(); err != nil {
+		t.Errorf("prepare(%q): %s", s.Cron, err)
+	}
+}
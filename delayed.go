@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor"
+)
+
+type DelayedCall struct {
+	Guid      string       `json:"guid"`
+	Function  string       `json:"function"`
+	Call      FunctionCall `json:"call"`
+	RunAt     time.Time    `json:"run_at"`
+	CreatedAt time.Time    `json:"created_at"`
+	LastError string       `json:"last_error,omitempty"`
+}
+
+func delayedPath(guid string) string {
+	return filepath.Join("delayed", guid+".json")
+}
+
+// dueAt works out when call should run from its run_at or delay, and reports
+// false if it should run straight away.
+func (call FunctionCall) dueAt(now time.Time) (time.Time, bool, error) {
+	if call.RunAt != nil && call.Delay != "" {
+		return time.Time{}, false, errors.New("only one of run_at and delay can be set")
+	}
+
+	runAt := now
+	if call.RunAt != nil {
+		runAt = *call.RunAt
+	}
+	if call.Delay != "" {
+		delay, err := time.ParseDuration(call.Delay)
+		if err != nil || delay < 0 {
+			return time.Time{}, false, fmt.Errorf("invalid delay: %s", call.Delay)
+		}
+		runAt = now.Add(delay)
+	}
+
+	return runAt, runAt.After(now), nil
+}
+
+var (
+	errDelayedNotFound = errors.New("could not find delayed call")
+	errDelayedStarting = errors.New("delayed call is already starting")
+)
+
+// delayedCalls holds calls until they are due, then starts them in the same
+// way as calls that arrive over HTTP.
+type delayedCalls struct {
+	sync.Mutex
+	calls map[string]*DelayedCall
+
+	// starting holds the calls being submitted, which can no longer be
+	// cancelled.
+	starting map[string]bool
+
+	// submit starts a due call. It is startDelayedCall unless a test has
+	// replaced it.
+	submit func(call DelayedCall) error
+}
+
+var delayed = &delayedCalls{
+	calls:    map[string]*DelayedCall{},
+	starting: map[string]bool{},
+}
+
+func (d *delayedCalls) load() error {
+	d.Lock()
+	defer d.Unlock()
+
+	return loadJSONDir("delayed", func(path string) error {
+		call := &DelayedCall{}
+		if err := loadJSON(path, call); err != nil {
+			return err
+		}
+		d.calls[call.Guid] = call
+		return nil
+	})
+}
+
+func (d *delayedCalls) hold(guid, function string, call FunctionCall, runAt time.Time) error {
+	d.Lock()
+	defer d.Unlock()
+
+	call.RunAt = nil
+	call.Delay = ""
+
+	held := &DelayedCall{
+		Guid:      guid,
+		Function:  function,
+		Call:      call,
+		RunAt:     runAt,
+		CreatedAt: time.Now(),
+	}
+	if err := saveJSON(delayedPath(guid), held); err != nil {
+		return err
+	}
+	d.calls[guid] = held
+
+	return nil
+}
+
+// cancel removes a call that has not started yet.
+func (d *delayedCalls) cancel(guid string) (DelayedCall, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	held, ok := d.calls[guid]
+	if !ok {
+		return DelayedCall{}, errDelayedNotFound
+	}
+	if d.starting[guid] {
+		return DelayedCall{}, errDelayedStarting
+	}
+	delete(d.calls, guid)
+	if err := os.Remove(delayedPath(guid)); err != nil {
+		log.Println("failed to remove delayed call:", err)
+	}
+
+	return *held, nil
+}
+
+func (d *delayedCalls) list(function string) []DelayedCall {
+	d.Lock()
+	defer d.Unlock()
+
+	list := []DelayedCall{}
+	for _, call := range d.calls {
+		if function == "" || call.Function == function {
+			list = append(list, *call)
+		}
+	}
+	sort.Sort(delayedByRunAt(list))
+
+	return list
+}
+
+func (d *delayedCalls) run() {
+	for now := range time.Tick(time.Second) {
+		d.startDue(now)
+	}
+}
+
+// startDue starts every call due by now. Each is marked as starting first,
+// so that it cannot be cancelled once it may have reached Diego.
+func (d *delayedCalls) startDue(now time.Time) {
+	d.Lock()
+	var due []DelayedCall
+	for _, call := range d.calls {
+		if !call.RunAt.After(now) && !d.starting[call.Guid] {
+			d.starting[call.Guid] = true
+			due = append(due, *call)
+		}
+	}
+	d.Unlock()
+
+	for _, call := range due {
+		d.start(call)
+	}
+}
+
+// start submits a due call that has been marked as starting. Calls that
+// fail for a reason that may pass, such as a full admission queue, are kept
+// and tried again a minute later. Calls that can never start are dropped and
+// completed as failed, so that their history, idempotency record and
+// triggering event are resolved.
+func (d *delayedCalls) start(call DelayedCall) {
+	submit := d.submit
+	if submit == nil {
+		submit = startDelayedCall
+	}
+	err := submit(call)
+
+	d.Lock()
+	delete(d.starting, call.Guid)
+	held, ok := d.calls[call.Guid]
+	if !ok {
+		d.Unlock()
+		return
+	}
+
+	if err != nil && !permanentStartError(err) {
+		log.Println("failed to start delayed call:", call.Guid, err)
+		held.LastError = err.Error()
+		held.RunAt = time.Now().Add(time.Minute)
+		if err := saveJSON(delayedPath(call.Guid), held); err != nil {
+			log.Println("failed to save delayed call:", err)
+		}
+		d.Unlock()
+		return
+	}
+
+	delete(d.calls, call.Guid)
+	if err := os.Remove(delayedPath(call.Guid)); err != nil {
+		log.Println("failed to remove delayed call:", err)
+	}
+	d.Unlock()
+
+	if err != nil {
+		log.Println("dropping delayed call:", call.Guid, err)
+		call.complete(err.Error())
+	}
+}
+
+func startDelayedCall(call DelayedCall) error {
+	if err := statFunction(call.Function); err != nil {
+		return err
+	}
+	if configs.get(call.Function).Type == functionTypeHTTP {
+		return errHTTPFunction
+	}
+	if err := cells.checkStack(stackFor(call.Function)); err != nil {
+		return err
+	}
+	_, err := startCall(call.Guid, call.Function, call.Call)
+	return err
+}
+
+// complete finishes a call that will never run as failed, so that
+// everything waiting on it is resolved.
+func (call DelayedCall) complete(reason string) {
+	annotation, _ := json.Marshal(taskAnnotation{Function: call.Function, Entry: call.Call.Entry})
+	taskCompleted(failedTask(receptor.TaskCreateRequest{
+		TaskGuid:   call.Guid,
+		Annotation: string(annotation),
+	}, reason))
+}
+
+// permanentStartError reports whether err means that a delayed call will
+// never start, however often it is tried.
+func permanentStartError(err error) bool {
+	switch err {
+	case errLocked, errHTTPFunction, errUnknownEntrypoint:
+		return true
+	}
+	if _, ok := err.(unavailableStackError); ok {
+		return true
+	}
+	return os.IsNotExist(err)
+}
+
+type delayedByRunAt []DelayedCall
+
+func (d delayedByRunAt) Len() int           { return len(d) }
+func (d delayedByRunAt) Less(i, j int) bool { return d[i].RunAt.Before(d[j].RunAt) }
+func (d delayedByRunAt) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+func listDelayedHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, delayed.list(r.URL.Query().Get("function")))
+}
+
+func cancelDelayedHandler(w http.ResponseWriter, r *http.Request) {
+	guid := r.URL.Query().Get(":guid")
+
+	call, err := delayed.cancel(guid)
+	switch err {
+	case nil:
+	case errDelayedStarting:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	call.complete("cancelled")
+	history.cancelled(guid)
+
+	io.WriteString(w, "cancelled delayed call: "+guid)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDelayedCancelAgainstStart(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		due  bool
+		// duringStart cancels while the call is being submitted, rather
+		// than once submitting is over.
+		duringStart bool
+		startErr    error
+		cancelErr   error
+	}{
+		{
+			name: "cancels a call that is not due",
+		},
+		{
+			name:        "refuses to cancel a call that is starting",
+			due:         true,
+			duringStart: true,
+			cancelErr:   errDelayedStarting,
+		},
+		{
+			name:      "finds nothing to cancel once a call has started",
+			due:       true,
+			cancelErr: errDelayedNotFound,
+		},
+		{
+			name:     "cancels a call kept to be tried again",
+			due:      true,
+			startErr: errQueueFull,
+		},
+		{
+			name:      "finds nothing to cancel once a call can never start",
+			due:       true,
+			startErr:  errUnknownEntrypoint,
+			cancelErr: errDelayedNotFound,
+		},
+	} {
+		submitting := make(chan DelayedCall, 1)
+		proceed := make(chan struct{})
+		d := &delayedCalls{
+			calls:    map[string]*DelayedCall{},
+			starting: map[string]bool{},
+			submit: func(call DelayedCall) error {
+				submitting <- call
+				<-proceed
+				return test.startErr
+			},
+		}
+
+		now := time.Now()
+		runAt := now.Add(time.Hour)
+		if test.due {
+			runAt = now
+		}
+		if err := d.hold("call", "fn", FunctionCall{}, runAt); err != nil {
+			t.Fatal(err)
+		}
+
+		started := make(chan struct{})
+		go func() {
+			d.startDue(now)
+			close(started)
+		}()
+
+		var err error
+		if test.due {
+			<-submitting
+			if test.duringStart {
+				_, err = d.cancel("call")
+			}
+			close(proceed)
+		}
+		<-started
+		if !test.duringStart {
+			_, err = d.cancel("call")
+		}
+
+		if err != test.cancelErr {
+			t.Errorf("%s: cancel returned %v, expected %v", test.name, err, test.cancelErr)
+		}
+		if !test.due && len(submitting) > 0 {
+			t.Errorf("%s: submitted a call that was not due", test.name)
+		}
+		if calls := d.list(""); len(calls) > 0 {
+			t.Errorf("%s: %d calls still held", test.name, len(calls))
+		}
+	}
+}
+
+func TestPermanentStartError(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		permanent bool
+	}{
+		{errLocked, true},
+		{errHTTPFunction, true},
+		{errUnknownEntrypoint, true},
+		{unavailableStackError("cflinuxfs2"), true},
+		{errQueueFull, false},
+		{errors.New("receptor is down"), false},
+	} {
+		if permanent := permanentStartError(test.err); permanent != test.permanent {
+			t.Errorf("permanentStartError(%q) = %t, expected %t", test.err, permanent, test.permanent)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const defaultEntrypoint = "run"
+
+var errUnknownEntrypoint = errors.New("could not find entrypoint")
+
+// Entrypoints are interpolated into shell commands, so only plain names are
+// accepted.
+var entrypointPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func entrypoint(entry string) string {
+	if entry == "" {
+		return defaultEntrypoint
+	}
+	return entry
+}
+
+// validEntrypoint checks that the function has entry. Every function is
+// assumed to have run, as functions registered before entrypoints were
+// recorded have nothing else.
+func validEntrypoint(function, entry string) error {
+	entry = entrypoint(entry)
+	if entry == defaultEntrypoint {
+		return nil
+	}
+
+	config := configs.get(function)
+	if config.Command == "" && entrypointPattern.MatchString(entry) && contains(config.Entrypoints, entry) {
+		return nil
+	}
+	return errUnknownEntrypoint
+}
+
+// packageEntrypoints lists the entrypoints in a function's tarball: the bin
+// entries in package.json for node packages, and the files in bin/ for
+// everything else.
+func packageEntrypoints(tarball, runtime string) ([]string, error) {
+	entries := []string{}
+
+	if runtime == "node" {
+		data, found, err := tarballFile(tarball, "package/package.json")
+		if err != nil || !found {
+			return entries, err
+		}
+
+		var pkg struct {
+			Name string          `json:"name"`
+			Bin  json.RawMessage `json:"bin"`
+		}
+		if err := json.Unmarshal(data, &pkg); err != nil {
+			return nil, errors.New("invalid package.json: " + err.Error())
+		}
+
+		var bins map[string]string
+		var bin string
+		switch {
+		case json.Unmarshal(pkg.Bin, &bins) == nil:
+			for name := range bins {
+				entries = append(entries, name)
+			}
+		case json.Unmarshal(pkg.Bin, &bin) == nil && pkg.Name != "":
+			// npm names a lone bin after the package.
+			entries = append(entries, path.Base(pkg.Name))
+		}
+	} else {
+		file, err := os.Open(tarball)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, errors.New("function is not a gzipped tarball")
+		}
+		tr := tar.NewReader(gz)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, errors.New("function is not a gzipped tarball")
+			}
+			name := strings.TrimPrefix(header.Name, "./")
+			if dir, file := path.Split(name); dir == "package/bin/" && file != "" {
+				entries = append(entries, file)
+			}
+		}
+	}
+
+	valid := []string{}
+	for _, entry := range entries {
+		if entrypointPattern.MatchString(entry) {
+			valid = append(valid, entry)
+		}
+	}
+	sort.Strings(valid)
+
+	return valid, nil
+}
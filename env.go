@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/runtime-schema/models"
+)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedEnvNames are set by the container or by gamma, and cannot be
+// overridden by operators, functions or callers. Names starting with GAMMA_
+// are reserved too.
+var reservedEnvNames = map[string]bool{
+	"PATH": true,
+	"HOME": true,
+	"PWD":  true,
+	"USER": true,
+	"PORT": true,
+}
+
+// defaultEnv is the operator's environment for every function, given as a
+// JSON list of names and values in DEFAULT_ENV. It is set on the task, so
+// anything a function or call sets takes precedence over it.
+var defaultEnv []receptor.EnvironmentVariable
+
+func validEnvName(name string) bool {
+	return envNamePattern.MatchString(name)
+}
+
+func validEnv(env []models.EnvironmentVariable) error {
+	for _, v := range env {
+		if !validEnvName(v.Name) {
+			return fmt.Errorf("invalid env name: %q", v.Name)
+		}
+		if reservedEnvNames[v.Name] || strings.HasPrefix(v.Name, "GAMMA_") {
+			return fmt.Errorf("env name is reserved: %s", v.Name)
+		}
+		if strings.ContainsRune(v.Value, 0) {
+			return fmt.Errorf("invalid value for env %s", v.Name)
+		}
+	}
+	return nil
+}
+
+func parseDefaultEnv(value string) ([]receptor.EnvironmentVariable, error) {
+	var env []models.EnvironmentVariable
+	if err := json.Unmarshal([]byte(value), &env); err != nil {
+		return nil, err
+	}
+	if err := validEnv(env); err != nil {
+		return nil, err
+	}
+
+	taskEnv := []receptor.EnvironmentVariable{}
+	for _, v := range mergeEnv(env) {
+		taskEnv = append(taskEnv, receptor.EnvironmentVariable{Name: v.Name, Value: v.Value})
+	}
+	return taskEnv, nil
+}
+
+// mergeEnv flattens layers of environment into one, where a name set in a
+// later layer replaces the same name from an earlier one.
+func mergeEnv(layers ...[]models.EnvironmentVariable) []models.EnvironmentVariable {
+	index := map[string]int{}
+	merged := []models.EnvironmentVariable{}
+	for _, layer := range layers {
+		for _, v := range layer {
+			if i, ok := index[v.Name]; ok {
+				merged[i].Value = v.Value
+				continue
+			}
+			index[v.Name] = len(merged)
+			merged = append(merged, v)
+		}
+	}
+	return merged
+}
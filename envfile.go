@@ -0,0 +1,426 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/runtime-schema/models"
+)
+
+const (
+	secretDeliveryEnv  = "env"
+	secretDeliveryFile = "file"
+)
+
+// envFileDir is where an env file is unpacked, relative to the function's
+// directory.
+const envFileDir = ".gamma"
+
+// envRefName marks where an inline env file's values go in a RunAction's
+// env, until the task is submitted.
+const envRefName = "GAMMA_ENV_REF"
+
+// envFile is a one-time token for a task to fetch its function's secrets and
+// service credentials. Only their names are kept; values are looked up when
+// the token is redeemed. Its lifetime starts when the task is submitted to Diego, so that
+// calls can wait in the admission queue without their tokens running out.
+//
+// Inline env files are never fetched. They stand in for secrets delivered as
+// env, so that tasks waiting in the queue or on a lock are saved without
+// secret values, which are only put into the task as it goes to Diego.
+type envFile struct {
+	Hash          string           `json:"hash"`
+	TaskGuid      string           `json:"task_guid"`
+	Secrets       []SecretRef      `json:"secrets"`
+	Services      []ServiceBinding `json:"services,omitempty"`
+	ServiceFormat string           `json:"service_format,omitempty"`
+	Inline        bool             `json:"inline,omitempty"`
+	ExpiresAt     *time.Time       `json:"expires_at,omitempty"`
+}
+
+func envFilePath(hash string) string {
+	return filepath.Join("envfiles", hash+".json")
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type envFileStore struct {
+	sync.Mutex
+	ttl   time.Duration
+	files map[string]*envFile
+}
+
+var envFiles = &envFileStore{
+	ttl:   5 * time.Minute,
+	files: map[string]*envFile{},
+}
+
+func validSecretDelivery(delivery string) error {
+	switch delivery {
+	case "", secretDeliveryEnv, secretDeliveryFile:
+		return nil
+	}
+	return fmt.Errorf("unknown secret delivery: %s", delivery)
+}
+
+// protectedEnv resolves the secrets and service credentials that a function
+// asks for. Secrets take precedence.
+func protectedEnv(refs []SecretRef, services []ServiceBinding, format string) ([]models.EnvironmentVariable, error) {
+	credentials, err := serviceEnv(services, format)
+	if err != nil {
+		return nil, err
+	}
+	secretEnv, err := secrets.env(refs)
+	if err != nil {
+		return nil, err
+	}
+	return mergeEnv(credentials, secretEnv), nil
+}
+
+func (file *envFile) env() ([]models.EnvironmentVariable, error) {
+	return protectedEnv(file.Secrets, file.Services, file.ServiceFormat)
+}
+
+// secretDelivery gets a function's secrets and service credentials to a
+// task, either as environment variables or as the URL of an env file for the
+// task to download. Environment variables are only a reference to an inline
+// env file until the task is submitted; see injectSecrets.
+func secretDelivery(guid, function string) ([]models.EnvironmentVariable, string, error) {
+	config := configs.get(function)
+
+	// Resolve them now, so that a call for missing secrets fails straight
+	// away rather than when it is submitted.
+	env, err := protectedEnv(config.Secrets, config.Services, config.ServiceFormat)
+	if err != nil || len(env) == 0 {
+		return nil, "", err
+	}
+
+	file := &envFile{
+		TaskGuid:      guid,
+		Secrets:       config.Secrets,
+		Services:      config.Services,
+		ServiceFormat: config.ServiceFormat,
+		Inline:        config.SecretDelivery != secretDeliveryFile,
+	}
+	token, err := envFiles.issue(file)
+	if err != nil {
+		return nil, "", err
+	}
+	if file.Inline {
+		return []models.EnvironmentVariable{{Name: envRefName, Value: file.Hash}}, "", nil
+	}
+	return nil, address() + "/envfile/" + token, nil
+}
+
+// injectSecrets replaces the references to inline env files in request with
+// their values. The request's actions are copied rather than changed, as the
+// request may be the one kept in the queue.
+func (s *envFileStore) injectSecrets(request receptor.TaskCreateRequest) (receptor.TaskCreateRequest, error) {
+	action, err := s.injectAction(request.Action)
+	if err != nil {
+		return request, err
+	}
+	request.Action = action
+	return request, nil
+}
+
+func (s *envFileStore) injectAction(action models.Action) (models.Action, error) {
+	switch a := action.(type) {
+	case *models.RunAction:
+		run := *a
+		env := []models.EnvironmentVariable{}
+		var secretEnv []models.EnvironmentVariable
+		for _, v := range a.Env {
+			if v.Name != envRefName {
+				env = append(env, v)
+				continue
+			}
+			values, err := s.inlineValues(v.Value)
+			if err != nil {
+				return nil, err
+			}
+			secretEnv = append(secretEnv, values...)
+		}
+		if secretEnv != nil {
+			env = mergeEnv(env, secretEnv)
+		}
+		run.Env = env
+		return &run, nil
+	case *models.EmitProgressAction:
+		copied := *a
+		inner, err := s.injectAction(a.Action)
+		copied.Action = inner
+		return &copied, err
+	case *models.TimeoutAction:
+		copied := *a
+		inner, err := s.injectAction(a.Action)
+		copied.Action = inner
+		return &copied, err
+	case *models.TryAction:
+		copied := *a
+		inner, err := s.injectAction(a.Action)
+		copied.Action = inner
+		return &copied, err
+	case *models.SerialAction:
+		actions, err := s.injectActions(a.Actions)
+		return &models.SerialAction{Actions: actions, LogSource: a.LogSource}, err
+	case *models.ParallelAction:
+		actions, err := s.injectActions(a.Actions)
+		return &models.ParallelAction{Actions: actions, LogSource: a.LogSource}, err
+	}
+	return action, nil
+}
+
+func (s *envFileStore) injectActions(actions []models.Action) ([]models.Action, error) {
+	injected := make([]models.Action, len(actions))
+	for i, action := range actions {
+		var err error
+		if injected[i], err = s.injectAction(action); err != nil {
+			return nil, err
+		}
+	}
+	return injected, nil
+}
+
+func (s *envFileStore) inlineValues(hash string) ([]models.EnvironmentVariable, error) {
+	s.Lock()
+	file, ok := s.files[hash]
+	s.Unlock()
+
+	if !ok || !file.Inline {
+		return nil, fmt.Errorf("could not find secrets for task")
+	}
+	return file.env()
+}
+
+// redactedSecretDelivery is secretDelivery for requests that are only shown,
+// never run. It issues no env file and hides every value.
+func redactedSecretDelivery(function string) ([]models.EnvironmentVariable, string, error) {
+	config := configs.get(function)
+
+	env, err := protectedEnv(config.Secrets, config.Services, config.ServiceFormat)
+	if err != nil {
+		return nil, "", err
+	}
+	if config.SecretDelivery == secretDeliveryFile && len(env) > 0 {
+		return nil, address() + "/envfile/REDACTED", nil
+	}
+
+	redacted := []models.EnvironmentVariable{}
+	for _, v := range env {
+		redacted = append(redacted, models.EnvironmentVariable{Name: v.Name, Value: "REDACTED"})
+	}
+	return redacted, "", nil
+}
+
+func (s *envFileStore) load() error {
+	s.Lock()
+	defer s.Unlock()
+
+	return loadJSONDir("envfiles", func(path string) error {
+		file := &envFile{}
+		if err := loadJSON(path, file); err != nil {
+			return err
+		}
+		s.files[file.Hash] = file
+		return nil
+	})
+}
+
+func (s *envFileStore) issue(file *envFile) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(random)
+
+	file.Hash = tokenHash(token)
+	if err := saveJSON(envFilePath(file.Hash), file); err != nil {
+		return "", err
+	}
+	s.files[file.Hash] = file
+
+	return token, nil
+}
+
+// activate starts the clock on the task's tokens.
+func (s *envFileStore) activate(guid string) {
+	s.Lock()
+	defer s.Unlock()
+
+	expiresAt := time.Now().Add(s.ttl)
+	for _, file := range s.files {
+		if file.TaskGuid == guid && file.ExpiresAt == nil {
+			file.ExpiresAt = &expiresAt
+			if err := saveJSON(envFilePath(file.Hash), file); err != nil {
+				log.Println("failed to save env file token:", err)
+			}
+		}
+	}
+}
+
+// redeem uses up a token, returning the env file it was issued for.
+func (s *envFileStore) redeem(token string) (*envFile, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	file, ok := s.files[tokenHash(token)]
+	if !ok || file.Inline {
+		return nil, false
+	}
+	s.remove(file)
+
+	if file.ExpiresAt == nil || time.Now().After(*file.ExpiresAt) {
+		return nil, false
+	}
+	return file, true
+}
+
+// values resolves the task's tokens without using them up, for warm pools,
+// which pass the environment straight to their instances. Inline env files
+// are left out, as they have already been injected into the task.
+func (s *envFileStore) values(guid string) ([]models.EnvironmentVariable, error) {
+	s.Lock()
+	var files []*envFile
+	for _, file := range s.files {
+		if file.TaskGuid == guid && !file.Inline {
+			files = append(files, file)
+		}
+	}
+	s.Unlock()
+
+	env := []models.EnvironmentVariable{}
+	for _, file := range files {
+		fileEnv, err := file.env()
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, fileEnv...)
+	}
+	return env, nil
+}
+
+// revoke removes the task's tokens, once it has finished or if it never
+// gets to run.
+func (s *envFileStore) revoke(guid string) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, file := range s.files {
+		if file.TaskGuid == guid {
+			s.remove(file)
+		}
+	}
+}
+
+func (s *envFileStore) taskCompleted(task receptor.TaskResponse) {
+	s.revoke(task.TaskGuid)
+}
+
+func (s *envFileStore) purge() {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	for _, file := range s.files {
+		if file.ExpiresAt != nil && now.After(*file.ExpiresAt) {
+			s.remove(file)
+		}
+	}
+}
+
+func (s *envFileStore) purgeEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.purge()
+	}
+}
+
+func (s *envFileStore) remove(file *envFile) {
+	delete(s.files, file.Hash)
+	if err := os.Remove(envFilePath(file.Hash)); err != nil && !os.IsNotExist(err) {
+		log.Println("failed to remove env file token:", err)
+	}
+}
+
+// shellQuote quotes value for a POSIX shell.
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// envArchive packs env into a gzipped tarball holding a single shell script
+// named env, which is what a DownloadAction expects to fetch.
+func envArchive(env []models.EnvironmentVariable) ([]byte, error) {
+	var script bytes.Buffer
+	for _, v := range env {
+		fmt.Fprintf(&script, "export %s=%s\n", v.Name, shellQuote(v.Value))
+	}
+
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	header := &tar.Header{
+		Name:    "env",
+		Mode:    0600,
+		Size:    int64(script.Len()),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(script.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return archive.Bytes(), nil
+}
+
+func envFileHandler(w http.ResponseWriter, r *http.Request) {
+	file, ok := envFiles.redeem(r.URL.Query().Get(":token"))
+	if !ok {
+		http.Error(w, "env file has expired or already been fetched", http.StatusGone)
+		return
+	}
+
+	env, err := file.env()
+	if err != nil {
+		log.Println("failed to resolve secrets for env file:", err)
+		http.Error(w, "could not resolve secrets", http.StatusInternalServerError)
+		return
+	}
+
+	archive, err := envArchive(env)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "could not build env file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(archive)
+}
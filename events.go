@@ -0,0 +1,627 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/runtime-schema/models"
+)
+
+// Message is a single delivery from an EventSource. Token carries whatever
+// the source needs to acknowledge that particular delivery.
+type Message struct {
+	ID      string
+	Subject string
+	Data    []byte
+	Token   string
+}
+
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// EventSource is a queue that gamma can consume messages from. A message is
+// acked once the call it caused has succeeded, and nacked once gamma has
+// given up on it, so that the source can deliver it again. Until then, gamma
+// regularly tells the source that the message is still being worked on.
+type EventSource interface {
+	Subscribe(subject, group string, handler func(Message)) (Subscription, error)
+	Ack(Message) error
+	Nack(Message) error
+	InProgress(Message) error
+}
+
+// channelSource is an in-process EventSource. Nacked messages are delivered
+// again after a delay that doubles each time, up to maxRedeliveries times,
+// after which they are dropped.
+type channelSource struct {
+	sync.Mutex
+	subscribers     map[string][]*channelSubscription
+	redeliveries    map[string]int
+	maxRedeliveries int
+	redeliveryDelay time.Duration
+}
+
+type channelSubscription struct {
+	source   *channelSource
+	subject  string
+	messages chan Message
+}
+
+func newChannelSource() *channelSource {
+	return &channelSource{
+		subscribers:     map[string][]*channelSubscription{},
+		redeliveries:    map[string]int{},
+		maxRedeliveries: 3,
+		redeliveryDelay: 10 * time.Second,
+	}
+}
+
+func (s *channelSource) Subscribe(subject, group string, handler func(Message)) (Subscription, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	sub := &channelSubscription{
+		source:   s,
+		subject:  subject,
+		messages: make(chan Message, 100),
+	}
+	s.subscribers[subject] = append(s.subscribers[subject], sub)
+
+	go func() {
+		for message := range sub.messages {
+			handler(message)
+		}
+	}()
+
+	return sub, nil
+}
+
+func (s *channelSource) Publish(subject string, data []byte) {
+	s.deliver(Message{
+		ID:      uuid.NewUUID().String(),
+		Subject: subject,
+		Data:    data,
+	})
+}
+
+func (s *channelSource) deliver(message Message) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, sub := range s.subscribers[message.Subject] {
+		sub.messages <- message
+	}
+}
+
+func (s *channelSource) Ack(message Message) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.redeliveries, message.ID)
+	return nil
+}
+
+func (s *channelSource) InProgress(message Message) error {
+	return nil
+}
+
+func (s *channelSource) Nack(message Message) error {
+	s.Lock()
+	defer s.Unlock()
+
+	redeliveries := s.redeliveries[message.ID]
+	if redeliveries >= s.maxRedeliveries {
+		log.Println("dropping event after too many redeliveries:", message.Subject, message.ID)
+		delete(s.redeliveries, message.ID)
+		return nil
+	}
+	s.redeliveries[message.ID] = redeliveries + 1
+
+	time.AfterFunc(s.redeliveryDelay<<uint(redeliveries), func() {
+		s.deliver(message)
+	})
+	return nil
+}
+
+func (sub *channelSubscription) Unsubscribe() error {
+	s := sub.source
+	s.Lock()
+	defer s.Unlock()
+
+	subs := s.subscribers[sub.subject]
+	for i, other := range subs {
+		if other == sub {
+			s.subscribers[sub.subject] = append(subs[:i], subs[i+1:]...)
+			close(sub.messages)
+			break
+		}
+	}
+
+	return nil
+}
+
+type EventSubscription struct {
+	Name        string       `json:"name"`
+	Source      string       `json:"source"`
+	Subject     string       `json:"subject"`
+	Group       string       `json:"group,omitempty"`
+	Function    string       `json:"function"`
+	MaxInFlight int          `json:"max_in_flight,omitempty"`
+	MaxAttempts int          `json:"max_attempts,omitempty"`
+	RetryDelay  string       `json:"retry_delay,omitempty"`
+	Batch       *BatchConfig `json:"batch,omitempty"`
+}
+
+// BatchConfig makes a subscription collect messages into batches, each
+// handled by a single call. A batch is sent when it reaches MaxCount messages
+// or MaxBytes of data, or MaxWait after its first message arrived.
+type BatchConfig struct {
+	MaxCount int    `json:"max_count,omitempty"`
+	MaxBytes int    `json:"max_bytes,omitempty"`
+	MaxWait  string `json:"max_wait,omitempty"`
+
+	maxWait time.Duration
+}
+
+func (b *BatchConfig) validate() error {
+	if b.MaxCount < 0 || b.MaxBytes < 0 {
+		return errors.New("max_count and max_bytes must not be negative")
+	}
+	if b.MaxCount == 0 {
+		b.MaxCount = 100
+	}
+	if b.MaxBytes == 0 {
+		b.MaxBytes = 256 * 1024
+	}
+	if b.MaxWait == "" {
+		b.MaxWait = "1s"
+	}
+
+	var err error
+	if b.maxWait, err = time.ParseDuration(b.MaxWait); err != nil || b.maxWait <= 0 {
+		return fmt.Errorf("invalid max_wait: %s", b.MaxWait)
+	}
+	return nil
+}
+
+func subscriptionPath(name string) string {
+	return filepath.Join("subscriptions", name+".json")
+}
+
+func (s *EventSubscription) validate() error {
+	if s.Subject == "" {
+		return errors.New("subscription has no subject")
+	}
+	if s.Function == "" {
+		return errors.New("subscription has no function")
+	}
+	if s.MaxInFlight < 0 || s.MaxAttempts < 0 {
+		return errors.New("max_in_flight and max_attempts must not be negative")
+	}
+	if s.MaxInFlight == 0 {
+		s.MaxInFlight = 10
+	}
+	if s.MaxAttempts == 0 {
+		s.MaxAttempts = 3
+	}
+	if s.RetryDelay != "" {
+		if delay, err := time.ParseDuration(s.RetryDelay); err != nil || delay < 0 {
+			return fmt.Errorf("invalid retry_delay: %s", s.RetryDelay)
+		}
+	}
+	if s.Batch != nil {
+		return s.Batch.validate()
+	}
+	return nil
+}
+
+type activeSubscription struct {
+	EventSubscription
+	source       EventSource
+	subscription Subscription
+	slots        chan struct{}
+
+	batchLock  sync.Mutex
+	batch      []Message
+	batchBytes int
+	batchTimer *time.Timer
+}
+
+type delivery struct {
+	subscription *activeSubscription
+	messages     []Message
+	attempt      int
+}
+
+// add collects message into the current batch, and returns the batch if it
+// is now full.
+func (sub *activeSubscription) add(message Message, flush func([]Message)) []Message {
+	sub.batchLock.Lock()
+	defer sub.batchLock.Unlock()
+
+	sub.batch = append(sub.batch, message)
+	sub.batchBytes += len(message.Data)
+
+	if len(sub.batch) >= sub.Batch.MaxCount || sub.batchBytes >= sub.Batch.MaxBytes {
+		return sub.take()
+	}
+
+	if len(sub.batch) == 1 {
+		sub.batchTimer = time.AfterFunc(sub.Batch.maxWait, func() {
+			sub.batchLock.Lock()
+			batch := sub.take()
+			sub.batchLock.Unlock()
+
+			if len(batch) > 0 {
+				flush(batch)
+			}
+		})
+	}
+
+	return nil
+}
+
+func (sub *activeSubscription) take() []Message {
+	if sub.batchTimer != nil {
+		sub.batchTimer.Stop()
+		sub.batchTimer = nil
+	}
+
+	batch := sub.batch
+	sub.batch = nil
+	sub.batchBytes = 0
+	return batch
+}
+
+// payload is the message's data for a single message, or a JSON array of
+// each message's data for a batch. Data that is not JSON is sent as a string.
+func (d *delivery) payload() json.RawMessage {
+	payloads := make([]json.RawMessage, len(d.messages))
+	for i, message := range d.messages {
+		payloads[i] = message.Data
+		if !json.Valid(message.Data) {
+			payloads[i], _ = json.Marshal(string(message.Data))
+		}
+	}
+
+	if d.subscription.Batch == nil {
+		return payloads[0]
+	}
+
+	batch, _ := json.Marshal(payloads)
+	return batch
+}
+
+// eventDispatcher turns messages from event sources into function calls,
+// limiting how many calls each subscription has outstanding and retrying
+// failed calls before giving the message back to its source.
+type eventDispatcher struct {
+	sync.Mutex
+	sources       map[string]EventSource
+	subscriptions map[string]*activeSubscription
+	tasks         map[string]*delivery
+
+	// call makes the call for a delivery, and is callSubscribedFunction
+	// unless set otherwise.
+	call func(function string, call FunctionCall) (FunctionCallResponse, error)
+
+	// unacked holds every message that has arrived but not yet been acked
+	// or nacked, whether it is waiting for a batch, a slot or its call.
+	unackedLock sync.Mutex
+	unacked     map[string]unackedMessage
+}
+
+type unackedMessage struct {
+	source  EventSource
+	message Message
+}
+
+var channelEvents = newChannelSource()
+
+var events = &eventDispatcher{
+	sources: map[string]EventSource{
+		"channel": channelEvents,
+	},
+	subscriptions: map[string]*activeSubscription{},
+	tasks:         map[string]*delivery{},
+	unacked:       map[string]unackedMessage{},
+}
+
+func (e *eventDispatcher) load() error {
+	return loadJSONDir("subscriptions", func(path string) error {
+		var sub EventSubscription
+		if err := loadJSON(path, &sub); err != nil {
+			return err
+		}
+		if err := sub.validate(); err != nil {
+			return fmt.Errorf("invalid subscription %s: %s", sub.Name, err)
+		}
+		return e.subscribe(sub)
+	})
+}
+
+func (e *eventDispatcher) subscribe(sub EventSubscription) error {
+	e.Lock()
+	defer e.Unlock()
+
+	source, ok := e.sources[sub.Source]
+	if !ok {
+		return fmt.Errorf("unknown event source: %s", sub.Source)
+	}
+
+	if existing, ok := e.subscriptions[sub.Name]; ok {
+		if err := existing.subscription.Unsubscribe(); err != nil {
+			return err
+		}
+		delete(e.subscriptions, sub.Name)
+	}
+
+	active := &activeSubscription{
+		EventSubscription: sub,
+		source:            source,
+		slots:             make(chan struct{}, sub.MaxInFlight),
+	}
+
+	var err error
+	active.subscription, err = source.Subscribe(sub.Subject, sub.Group, func(message Message) {
+		e.track(source, message)
+
+		if active.Batch == nil {
+			go e.handle(active, []Message{message})
+			return
+		}
+
+		flush := func(batch []Message) {
+			e.handle(active, batch)
+		}
+		if batch := active.add(message, flush); batch != nil {
+			go flush(batch)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	e.subscriptions[sub.Name] = active
+
+	return nil
+}
+
+func (e *eventDispatcher) unsubscribe(name string) (bool, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	active, ok := e.subscriptions[name]
+	if !ok {
+		return false, nil
+	}
+	delete(e.subscriptions, name)
+
+	return true, active.subscription.Unsubscribe()
+}
+
+func (e *eventDispatcher) handle(sub *activeSubscription, messages []Message) {
+	sub.slots <- struct{}{}
+
+	e.Lock()
+	defer e.Unlock()
+
+	e.submit(&delivery{
+		subscription: sub,
+		messages:     messages,
+		attempt:      1,
+	})
+}
+
+func (e *eventDispatcher) submit(d *delivery) {
+	sub := d.subscription
+
+	call := FunctionCall{
+		Env: []models.EnvironmentVariable{
+			{Name: "GAMMA_EVENT_SUBJECT", Value: d.messages[0].Subject},
+			{Name: "GAMMA_EVENT_ATTEMPT", Value: fmt.Sprint(d.attempt)},
+		},
+		Payload: d.payload(),
+		Caller:  "subscription:" + sub.Name,
+	}
+	if sub.Batch != nil {
+		call.Env = append(call.Env, models.EnvironmentVariable{
+			Name:  "GAMMA_BATCH_SIZE",
+			Value: fmt.Sprint(len(d.messages)),
+		})
+	}
+	if d.attempt > 1 {
+		call.Delay = sub.RetryDelay
+	}
+
+	callSubscribed := e.call
+	if callSubscribed == nil {
+		callSubscribed = callSubscribedFunction
+	}
+
+	response, err := callSubscribed(sub.Function, call)
+	if err == nil {
+		e.tasks[response.Guid] = d
+		return
+	}
+
+	log.Println("failed to call function for event:", sub.Name, err)
+	e.failed(d)
+}
+
+func callSubscribedFunction(function string, call FunctionCall) (FunctionCallResponse, error) {
+	if err := statFunction(function); err != nil {
+		return FunctionCallResponse{}, errors.New("could not find function")
+	}
+	return callFunction(function, call)
+}
+
+func (e *eventDispatcher) taskCompleted(task receptor.TaskResponse) {
+	e.Lock()
+	defer e.Unlock()
+
+	d, ok := e.tasks[task.TaskGuid]
+	if !ok {
+		return
+	}
+	delete(e.tasks, task.TaskGuid)
+
+	if task.Failed {
+		e.failed(d)
+		return
+	}
+
+	for _, message := range d.messages {
+		e.untrack(message)
+		if err := d.subscription.source.Ack(message); err != nil {
+			log.Println("failed to ack event:", message.ID, err)
+		}
+	}
+	<-d.subscription.slots
+}
+
+func (e *eventDispatcher) failed(d *delivery) {
+	if d.attempt < d.subscription.MaxAttempts {
+		d.attempt++
+		e.submit(d)
+		return
+	}
+
+	for _, message := range d.messages {
+		e.untrack(message)
+		if err := d.subscription.source.Nack(message); err != nil {
+			log.Println("failed to nack event:", message.ID, err)
+		}
+	}
+	<-d.subscription.slots
+}
+
+func (e *eventDispatcher) track(source EventSource, message Message) {
+	e.unackedLock.Lock()
+	defer e.unackedLock.Unlock()
+
+	e.unacked[message.ID] = unackedMessage{source: source, message: message}
+}
+
+func (e *eventDispatcher) untrack(message Message) {
+	e.unackedLock.Lock()
+	defer e.unackedLock.Unlock()
+
+	delete(e.unacked, message.ID)
+}
+
+// progress tells sources that their unacked messages are still being
+// worked on, so that they are not redelivered while their calls run.
+func (e *eventDispatcher) progress() {
+	e.unackedLock.Lock()
+	unacked := make([]unackedMessage, 0, len(e.unacked))
+	for _, u := range e.unacked {
+		unacked = append(unacked, u)
+	}
+	e.unackedLock.Unlock()
+
+	for _, u := range unacked {
+		if err := u.source.InProgress(u.message); err != nil {
+			log.Println("failed to report event in progress:", u.message.ID, err)
+		}
+	}
+}
+
+func (e *eventDispatcher) progressEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		e.progress()
+	}
+}
+
+func (e *eventDispatcher) list() []EventSubscription {
+	e.Lock()
+	defer e.Unlock()
+
+	list := []EventSubscription{}
+	for _, active := range e.subscriptions {
+		list = append(list, active.EventSubscription)
+	}
+	return list
+}
+
+func putSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	var sub EventSubscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sub.Name = name
+
+	if err := sub.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := statFunction(sub.Function); err != nil {
+		http.Error(w, "could not find function", http.StatusNotFound)
+		return
+	}
+
+	if err := events.subscribe(sub); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := saveJSON(subscriptionPath(name), sub); err != nil {
+		log.Println(err)
+		http.Error(w, "could not save subscription", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, sub)
+}
+
+func listSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, events.list())
+}
+
+func deleteSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	found, err := events.unsubscribe(name)
+	if !found {
+		http.Error(w, "could not find subscription", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("failed to unsubscribe:", err)
+	}
+
+	if err := os.Remove(subscriptionPath(name)); err != nil {
+		log.Println("failed to remove subscription:", err)
+	}
+
+	io.WriteString(w, "deleted subscription: "+name)
+}
+
+func publishEventHandler(w http.ResponseWriter, r *http.Request) {
+	subject := r.URL.Query().Get(":subject")
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	channelEvents.Publish(subject, data)
+	io.WriteString(w, "published event: "+subject)
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor"
+)
+
+const testTimeout = 2 * time.Second
+
+// recordingSource is a channel source that reports every ack and nack.
+type recordingSource struct {
+	*channelSource
+	acks  chan Message
+	nacks chan Message
+}
+
+func newRecordingSource() *recordingSource {
+	return &recordingSource{
+		channelSource: newChannelSource(),
+		acks:          make(chan Message, 100),
+		nacks:         make(chan Message, 100),
+	}
+}
+
+func (s *recordingSource) Ack(message Message) error {
+	s.acks <- message
+	return s.channelSource.Ack(message)
+}
+
+func (s *recordingSource) Nack(message Message) error {
+	s.nacks <- message
+	return nil
+}
+
+type testCall struct {
+	guid string
+	call FunctionCall
+}
+
+// newTestDispatcher returns a dispatcher whose calls are reported on the
+// returned channel instead of being run.
+func newTestDispatcher(source EventSource) (*eventDispatcher, chan testCall) {
+	calls := make(chan testCall, 100)
+	n := 0
+
+	e := &eventDispatcher{
+		sources:       map[string]EventSource{"test": source},
+		subscriptions: map[string]*activeSubscription{},
+		tasks:         map[string]*delivery{},
+		unacked:       map[string]unackedMessage{},
+	}
+	e.call = func(function string, call FunctionCall) (FunctionCallResponse, error) {
+		n++
+		guid := fmt.Sprintf("task-%d", n)
+		calls <- testCall{guid: guid, call: call}
+		return FunctionCallResponse{Guid: guid, Status: callStatusPending}, nil
+	}
+
+	return e, calls
+}
+
+func subscribeTest(t *testing.T, e *eventDispatcher, sub EventSubscription) {
+	sub.Name = "test"
+	sub.Source = "test"
+	sub.Subject = "orders"
+	sub.Function = "fulfil"
+	if err := sub.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.subscribe(sub); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func nextCall(t *testing.T, calls chan testCall) testCall {
+	select {
+	case call := <-calls:
+		return call
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for a call")
+	}
+	return testCall{}
+}
+
+func noCall(t *testing.T, calls chan testCall) {
+	select {
+	case call := <-calls:
+		t.Fatalf("unexpected call: %s", call.call.Payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func nextMessage(t *testing.T, messages chan Message, what string) Message {
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(testTimeout):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+	return Message{}
+}
+
+func envValue(call FunctionCall, name string) string {
+	for _, v := range call.Env {
+		if v.Name == name {
+			return v.Value
+		}
+	}
+	return ""
+}
+
+func complete(e *eventDispatcher, guid string, failed bool) {
+	e.taskCompleted(receptor.TaskResponse{TaskGuid: guid, Failed: failed})
+}
+
+func TestEventSubscriptionCallsFunction(t *testing.T) {
+	source := newRecordingSource()
+	e, calls := newTestDispatcher(source)
+	subscribeTest(t, e, EventSubscription{})
+
+	source.Publish("orders", []byte(`{"id": 1}`))
+	source.Publish("refunds", []byte(`{"id": 2}`))
+
+	call := nextCall(t, calls)
+	if string(call.call.Payload) != `{"id": 1}` {
+		t.Errorf("payload = %s", call.call.Payload)
+	}
+	if subject := envValue(call.call, "GAMMA_EVENT_SUBJECT"); subject != "orders" {
+		t.Errorf("GAMMA_EVENT_SUBJECT = %q", subject)
+	}
+	if attempt := envValue(call.call, "GAMMA_EVENT_ATTEMPT"); attempt != "1" {
+		t.Errorf("GAMMA_EVENT_ATTEMPT = %q", attempt)
+	}
+	if call.call.Caller != "subscription:test" {
+		t.Errorf("caller = %q", call.call.Caller)
+	}
+	noCall(t, calls)
+}
+
+func TestEventAckedOnSuccess(t *testing.T) {
+	source := newRecordingSource()
+	e, calls := newTestDispatcher(source)
+	subscribeTest(t, e, EventSubscription{})
+
+	source.Publish("orders", []byte(`{}`))
+	call := nextCall(t, calls)
+	complete(e, call.guid, false)
+
+	nextMessage(t, source.acks, "ack")
+	if len(source.nacks) != 0 {
+		t.Error("message was nacked")
+	}
+	if len(e.unacked) != 0 {
+		t.Error("message is still tracked after its ack")
+	}
+}
+
+func TestEventRetriedThenNacked(t *testing.T) {
+	source := newRecordingSource()
+	e, calls := newTestDispatcher(source)
+	subscribeTest(t, e, EventSubscription{MaxAttempts: 2, RetryDelay: "5s"})
+
+	source.Publish("orders", []byte(`{}`))
+
+	first := nextCall(t, calls)
+	if first.call.Delay != "" {
+		t.Errorf("first attempt delayed by %s", first.call.Delay)
+	}
+	complete(e, first.guid, true)
+
+	second := nextCall(t, calls)
+	if attempt := envValue(second.call, "GAMMA_EVENT_ATTEMPT"); attempt != "2" {
+		t.Errorf("GAMMA_EVENT_ATTEMPT = %q", attempt)
+	}
+	if second.call.Delay != "5s" {
+		t.Errorf("retry delayed by %q", second.call.Delay)
+	}
+	if len(source.nacks) != 0 {
+		t.Error("message nacked before its last attempt")
+	}
+	complete(e, second.guid, true)
+
+	nextMessage(t, source.nacks, "nack")
+	noCall(t, calls)
+	if len(source.acks) != 0 {
+		t.Error("message was acked")
+	}
+}
+
+func TestEventMaxInFlight(t *testing.T) {
+	source := newRecordingSource()
+	e, calls := newTestDispatcher(source)
+	subscribeTest(t, e, EventSubscription{MaxInFlight: 1})
+
+	source.Publish("orders", []byte(`1`))
+	source.Publish("orders", []byte(`2`))
+
+	first := nextCall(t, calls)
+	noCall(t, calls)
+
+	complete(e, first.guid, false)
+	second := nextCall(t, calls)
+	if string(first.call.Payload) == string(second.call.Payload) {
+		t.Errorf("the same message was called twice: %s", first.call.Payload)
+	}
+}
+
+func TestEventBatchFlushedByCount(t *testing.T) {
+	source := newRecordingSource()
+	e, calls := newTestDispatcher(source)
+	subscribeTest(t, e, EventSubscription{Batch: &BatchConfig{MaxCount: 3, MaxWait: "1h"}})
+
+	source.Publish("orders", []byte(`1`))
+	source.Publish("orders", []byte(`2`))
+	noCall(t, calls)
+	source.Publish("orders", []byte(`3`))
+
+	call := nextCall(t, calls)
+	if string(call.call.Payload) != `[1,2,3]` {
+		t.Errorf("payload = %s", call.call.Payload)
+	}
+	if size := envValue(call.call, "GAMMA_BATCH_SIZE"); size != "3" {
+		t.Errorf("GAMMA_BATCH_SIZE = %q", size)
+	}
+
+	complete(e, call.guid, false)
+	for i := 0; i < 3; i++ {
+		nextMessage(t, source.acks, "ack")
+	}
+}
+
+func TestEventBatchFlushedByBytes(t *testing.T) {
+	source := newRecordingSource()
+	e, calls := newTestDispatcher(source)
+	subscribeTest(t, e, EventSubscription{Batch: &BatchConfig{MaxBytes: 10, MaxWait: "1h"}})
+
+	source.Publish("orders", []byte(`"abcd"`))
+	noCall(t, calls)
+	source.Publish("orders", []byte(`"efgh"`))
+
+	call := nextCall(t, calls)
+	if string(call.call.Payload) != `["abcd","efgh"]` {
+		t.Errorf("payload = %s", call.call.Payload)
+	}
+}
+
+func TestEventBatchFlushedByWait(t *testing.T) {
+	source := newRecordingSource()
+	e, calls := newTestDispatcher(source)
+	subscribeTest(t, e, EventSubscription{Batch: &BatchConfig{MaxWait: "50ms"}})
+
+	start := time.Now()
+	source.Publish("orders", []byte(`not json`))
+
+	call := nextCall(t, calls)
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("batch flushed after %s", waited)
+	}
+	if string(call.call.Payload) != `["not json"]` {
+		t.Errorf("payload = %s", call.call.Payload)
+	}
+	if size := envValue(call.call, "GAMMA_BATCH_SIZE"); size != "1" {
+		t.Errorf("GAMMA_BATCH_SIZE = %q", size)
+	}
+}
+
+func TestChannelSourceRedeliveryIsCapped(t *testing.T) {
+	source := newChannelSource()
+	source.maxRedeliveries = 2
+	source.redeliveryDelay = 10 * time.Millisecond
+
+	received := make(chan Message, 10)
+	if _, err := source.Subscribe("orders", "", func(message Message) {
+		received <- message
+		source.Nack(message)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	source.Publish("orders", []byte(`{}`))
+	for i := 0; i < 3; i++ {
+		nextMessage(t, received, "delivery")
+	}
+
+	select {
+	case <-received:
+		t.Fatal("message redelivered more than twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// fakeNATSServer accepts a single client, answers its pings and reports each
+// line it sends.
+type fakeNATSServer struct {
+	listener net.Listener
+	accepted chan net.Conn
+	lines    chan string
+}
+
+func newFakeNATSServer(t *testing.T) *fakeNATSServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &fakeNATSServer{
+		listener: listener,
+		accepted: make(chan net.Conn, 1),
+		lines:    make(chan string, 100),
+	}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		fmt.Fprint(conn, "INFO {\"max_payload\":1048576}\r\n")
+		server.accepted <- conn
+
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			if line == "PING" {
+				fmt.Fprint(conn, "PONG\r\n")
+				continue
+			}
+			server.lines <- line
+		}
+	}()
+
+	return server
+}
+
+func (s *fakeNATSServer) expect(t *testing.T, prefix string) string {
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case line := <-s.lines:
+			if strings.HasPrefix(line, prefix) {
+				return line
+			}
+		case <-deadline:
+			t.Fatalf("timed out waiting for %q from the client", prefix)
+		}
+	}
+}
+
+func TestNATSSourceAcksThroughReplySubject(t *testing.T) {
+	server := newFakeNATSServer(t)
+	defer server.listener.Close()
+
+	source, err := newNATSSource("nats://" + server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.conn.Close()
+
+	received := make(chan Message, 10)
+	if _, err := source.Subscribe("orders", "gamma", func(message Message) {
+		received <- message
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := <-server.accepted
+	defer conn.Close()
+
+	server.expect(t, "CONNECT ")
+	sub := strings.Fields(server.expect(t, "SUB "))
+	if len(sub) != 4 || sub[1] != "orders" || sub[2] != "gamma" {
+		t.Fatalf("unexpected SUB: %v", sub)
+	}
+
+	fmt.Fprintf(conn, "MSG orders %s $JS.ACK.orders.1 2\r\n{}\r\n", sub[3])
+	message := nextMessage(t, received, "message")
+	if string(message.Data) != "{}" || message.Token != "$JS.ACK.orders.1" {
+		t.Fatalf("unexpected message: %+v", message)
+	}
+
+	for _, c := range []struct {
+		send func(Message) error
+		body string
+	}{
+		{source.InProgress, "+WPI"},
+		{source.Ack, "+ACK"},
+		{source.Nack, "-NAK"},
+	} {
+		if err := c.send(message); err != nil {
+			t.Fatal(err)
+		}
+		if pub := server.expect(t, "PUB "); pub != fmt.Sprintf("PUB $JS.ACK.orders.1 %d", len(c.body)) {
+			t.Errorf("unexpected PUB: %q", pub)
+		}
+		if body := <-server.lines; body != c.body {
+			t.Errorf("sent %q, want %q", body, c.body)
+		}
+	}
+}
+
+func TestEventProgressReportsUnackedMessages(t *testing.T) {
+	source := &progressSource{recordingSource: newRecordingSource(), progress: make(chan Message, 10)}
+	e, calls := newTestDispatcher(source)
+	subscribeTest(t, e, EventSubscription{})
+
+	source.Publish("orders", []byte(`{}`))
+	call := nextCall(t, calls)
+
+	e.progress()
+	nextMessage(t, source.progress, "progress")
+
+	complete(e, call.guid, false)
+	e.progress()
+	if len(source.progress) != 0 {
+		t.Error("progress reported for an acked message")
+	}
+}
+
+type progressSource struct {
+	*recordingSource
+	progress chan Message
+}
+
+func (s *progressSource) InProgress(message Message) error {
+	s.progress <- message
+	return nil
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor"
+)
+
+// CallRecord is the history of a single function call, from when it was
+// submitted to when its task completed.
+type CallRecord struct {
+	Guid     string `json:"guid"`
+	Function string `json:"function"`
+	// Version identifies what was registered as the function when it was
+	// called.
+	Version       string            `json:"version,omitempty"`
+	Entry         string            `json:"entry,omitempty"`
+	Caller        string            `json:"caller,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Status        string            `json:"status"`
+	SubmittedAt   time.Time         `json:"submitted_at"`
+	StartedAt     *time.Time        `json:"started_at,omitempty"`
+	CompletedAt   *time.Time        `json:"completed_at,omitempty"`
+	Failed        bool              `json:"failed"`
+	FailureReason string            `json:"failure_reason,omitempty"`
+	Result        string            `json:"result,omitempty"`
+}
+
+func callPath(guid string) string {
+	return filepath.Join("calls", guid+".json")
+}
+
+// functionVersion identifies a registration by a SHA-256 hash of what was
+// registered.
+func functionVersion(hash hash.Hash) string {
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// httpCaller names the client that made a call over HTTP, as seen through
+// the router.
+func httpCaller(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return "http:" + strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "http:" + host
+}
+
+// HistoryConfig overrides how long a function's calls are kept. Whatever is
+// left out falls back to the global setting.
+type HistoryConfig struct {
+	MaxAge   string `json:"max_age,omitempty"`
+	MaxCalls *int   `json:"max_calls,omitempty"`
+}
+
+func (config HistoryConfig) validate() error {
+	if config.MaxAge != "" {
+		if maxAge, err := time.ParseDuration(config.MaxAge); err != nil || maxAge < 0 {
+			return fmt.Errorf("invalid max_age: %s", config.MaxAge)
+		}
+	}
+	if config.MaxCalls != nil && *config.MaxCalls < 0 {
+		return errors.New("max_calls must not be negative")
+	}
+	return nil
+}
+
+// callHistory records every function call and how it turned out. Calls are
+// kept for maxAge, and only the newest maxPerFunction finished calls of each
+// function are kept, unless the function's config says otherwise.
+type callHistory struct {
+	sync.Mutex
+	records        map[string]*CallRecord
+	maxAge         time.Duration
+	maxPerFunction int
+}
+
+var history = &callHistory{
+	records:        map[string]*CallRecord{},
+	maxAge:         30 * 24 * time.Hour,
+	maxPerFunction: 1000,
+}
+
+func (h *callHistory) load() error {
+	h.Lock()
+	defer h.Unlock()
+
+	return loadJSONDir("calls", func(path string) error {
+		record := &CallRecord{}
+		if err := loadJSON(path, record); err != nil {
+			return err
+		}
+		h.records[record.Guid] = record
+		return nil
+	})
+}
+
+func (h *callHistory) save(record *CallRecord) {
+	if err := saveJSON(callPath(record.Guid), record); err != nil {
+		log.Println("failed to save call record:", err)
+	}
+}
+
+// submitted records a call as it is accepted, with the status it was given.
+// Delayed calls are recorded again when they start. A call that has already
+// finished, as one run on a warm pool can before it is recorded, only gains
+// what is known about it from its submission.
+func (h *callHistory) submitted(guid, function string, call FunctionCall, status string) {
+	h.Lock()
+	defer h.Unlock()
+
+	now := time.Now()
+
+	record, ok := h.records[guid]
+	if ok && record.finished() {
+		record.Version = configs.get(function).Version
+		record.Caller = call.Caller
+		record.Labels = call.Labels
+		h.save(record)
+		return
+	}
+	if !ok {
+		record = &CallRecord{
+			Guid:        guid,
+			Function:    function,
+			Version:     configs.get(function).Version,
+			Entry:       entrypoint(call.Entry),
+			Caller:      call.Caller,
+			Labels:      call.Labels,
+			SubmittedAt: now,
+		}
+		h.records[guid] = record
+	}
+	record.Status = status
+	if status == callStatusPending {
+		record.StartedAt = &now
+	}
+
+	h.save(record)
+}
+
+// started records that a call that was queued, waiting or delayed has been
+// sent to Diego. Calls sent straight away are recorded as started when they
+// are submitted, which is after this.
+func (h *callHistory) started(guid string) {
+	h.Lock()
+	defer h.Unlock()
+
+	record, ok := h.records[guid]
+	if !ok || record.finished() || record.Status == callStatusPending {
+		return
+	}
+	now := time.Now()
+	record.Status = callStatusPending
+	record.StartedAt = &now
+
+	h.save(record)
+}
+
+func (h *callHistory) cancelled(guid string) {
+	h.Lock()
+	defer h.Unlock()
+
+	record, ok := h.records[guid]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	record.Status = callStatusCancelled
+	record.CompletedAt = &now
+
+	h.save(record)
+}
+
+func (h *callHistory) taskCompleted(task receptor.TaskResponse) {
+	var annotation taskAnnotation
+	json.Unmarshal([]byte(task.Annotation), &annotation)
+	if annotation.Function == "" {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	now := time.Now()
+
+	record, ok := h.records[task.TaskGuid]
+	if !ok {
+		// The call was made before gamma kept a history.
+		record = &CallRecord{
+			Guid:        task.TaskGuid,
+			Function:    annotation.Function,
+			Entry:       entrypoint(annotation.Entry),
+			SubmittedAt: time.Unix(0, task.CreatedAt),
+		}
+		h.records[task.TaskGuid] = record
+	}
+
+	record.Status = callStatusSucceeded
+	if task.Failed {
+		record.Status = callStatusFailed
+	}
+	record.CompletedAt = &now
+	record.Failed = task.Failed
+	record.FailureReason = task.FailureReason
+	record.Result = task.Result
+
+	h.save(record)
+}
+
+func (h *callHistory) get(guid string) (CallRecord, bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	record, ok := h.records[guid]
+	if !ok {
+		return CallRecord{}, false
+	}
+	return *record, true
+}
+
+func getCallHandler(w http.ResponseWriter, r *http.Request) {
+	record, ok := history.get(r.URL.Query().Get(":guid"))
+	if !ok {
+		http.Error(w, "could not find call", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, record)
+}
+
+const (
+	maxLabels          = 16
+	maxLabelNameLength = 64
+	maxLabelLength     = 256
+)
+
+// validLabels checks the labels a caller attaches to a call, which are only
+// kept for finding the call again.
+func validLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("a call can have at most %d labels", maxLabels)
+	}
+	for name, value := range labels {
+		if name == "" || len(name) > maxLabelNameLength || strings.ContainsAny(name, "=,") {
+			return fmt.Errorf("invalid label name: %q", name)
+		}
+		if len(value) > maxLabelLength {
+			return fmt.Errorf("label %s is longer than %d bytes", name, maxLabelLength)
+		}
+	}
+	return nil
+}
+
+// CallFilter picks out calls from the history. Empty fields match every
+// call.
+type CallFilter struct {
+	Function string
+	Version  string
+	// State is succeeded, failed or running, which is any call that has
+	// not finished, or one of the other call statuses.
+	State string
+	Since time.Time
+	Until time.Time
+	// Labels must all be on the call. An empty value only needs the label
+	// to be there.
+	Labels map[string]string
+}
+
+func (record *CallRecord) finished() bool {
+	switch record.Status {
+	case callStatusSucceeded, callStatusFailed, callStatusCancelled:
+		return true
+	}
+	return false
+}
+
+func (f CallFilter) matches(record *CallRecord) bool {
+	if f.Function != "" && record.Function != f.Function {
+		return false
+	}
+	if f.Version != "" && record.Version != f.Version {
+		return false
+	}
+	if f.State == "running" && record.finished() {
+		return false
+	}
+	if f.State != "" && f.State != "running" && record.Status != f.State {
+		return false
+	}
+	if !f.Since.IsZero() && record.SubmittedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !record.SubmittedAt.Before(f.Until) {
+		return false
+	}
+	for name, value := range f.Labels {
+		label, ok := record.Labels[name]
+		if !ok || value != "" && label != value {
+			return false
+		}
+	}
+	return true
+}
+
+// callsByNewest orders calls newest first, breaking ties by guid so that
+// cursors are stable.
+type callsByNewest []*CallRecord
+
+func (c callsByNewest) Len() int      { return len(c) }
+func (c callsByNewest) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c callsByNewest) Less(i, j int) bool {
+	if !c[i].SubmittedAt.Equal(c[j].SubmittedAt) {
+		return c[i].SubmittedAt.After(c[j].SubmittedAt)
+	}
+	return c[i].Guid < c[j].Guid
+}
+
+// callCursor marks where a page of calls ended. The next page starts with
+// the call after it.
+func callCursor(record CallRecord) string {
+	return base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("%d/%s", record.SubmittedAt.UnixNano(), record.Guid)))
+}
+
+func parseCallCursor(cursor string) (*CallRecord, error) {
+	data, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	parts := strings.SplitN(string(data), "/", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("invalid cursor")
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	return &CallRecord{SubmittedAt: time.Unix(0, nanos), Guid: parts[1]}, nil
+}
+
+// list returns up to limit calls matching filter, newest first, starting
+// after the call at after if it is set. A limit of 0 returns every match.
+func (h *callHistory) list(filter CallFilter, after *CallRecord, limit int) []CallRecord {
+	h.Lock()
+	defer h.Unlock()
+
+	matches := []*CallRecord{}
+	for _, record := range h.records {
+		if filter.matches(record) {
+			matches = append(matches, record)
+		}
+	}
+	sort.Sort(callsByNewest(matches))
+
+	list := []CallRecord{}
+	for _, record := range matches {
+		if after != nil && !callsByNewest([]*CallRecord{after, record}).Less(0, 1) {
+			continue
+		}
+		if limit > 0 && len(list) == limit {
+			break
+		}
+		list = append(list, *record)
+	}
+	return list
+}
+
+// retention returns how long function's calls are kept, and how many of its
+// finished calls are kept.
+func (h *callHistory) retention(function string) (time.Duration, int) {
+	maxAge, maxCalls := h.maxAge, h.maxPerFunction
+
+	config := configs.get(function).History
+	if config == nil {
+		return maxAge, maxCalls
+	}
+	if config.MaxAge != "" {
+		maxAge, _ = time.ParseDuration(config.MaxAge)
+	}
+	if config.MaxCalls != nil {
+		maxCalls = *config.MaxCalls
+	}
+	return maxAge, maxCalls
+}
+
+// purge removes calls older than their function's max age, and finished calls
+// beyond the newest max calls of each function. Zero turns either off.
+func (h *callHistory) purge() {
+	h.Lock()
+	defer h.Unlock()
+
+	byFunction := map[string][]*CallRecord{}
+	for _, record := range h.records {
+		byFunction[record.Function] = append(byFunction[record.Function], record)
+	}
+
+	for function, records := range byFunction {
+		maxAge, maxCalls := h.retention(function)
+
+		sort.Sort(callsByNewest(records))
+		kept := 0
+		for _, record := range records {
+			if maxAge > 0 && time.Since(record.SubmittedAt) > maxAge {
+				h.remove(record)
+				continue
+			}
+			if maxCalls <= 0 || !record.finished() {
+				continue
+			}
+			if kept < maxCalls {
+				kept++
+				continue
+			}
+			h.remove(record)
+		}
+	}
+}
+
+func (h *callHistory) purgeEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		h.purge()
+	}
+}
+
+func (h *callHistory) remove(record *CallRecord) {
+	delete(h.records, record.Guid)
+	if err := os.Remove(callPath(record.Guid)); err != nil && !os.IsNotExist(err) {
+		log.Println("failed to remove call record:", err)
+	}
+}
+
+type CallList struct {
+	Calls      []CallRecord `json:"calls"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+func parseCallFilter(query url.Values) (CallFilter, error) {
+	filter := CallFilter{
+		Function: query.Get("function"),
+		Version:  query.Get("version"),
+		State:    query.Get("state"),
+		Labels:   map[string]string{},
+	}
+
+	for _, param := range []string{"since", "until"} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s: %s", param, value)
+		}
+		if param == "since" {
+			filter.Since = t
+		} else {
+			filter.Until = t
+		}
+	}
+
+	for _, label := range query["label"] {
+		parts := strings.SplitN(label, "=", 2)
+		if parts[0] == "" {
+			return filter, fmt.Errorf("invalid label: %s", label)
+		}
+		if len(parts) == 2 {
+			filter.Labels[parts[0]] = parts[1]
+		} else {
+			filter.Labels[parts[0]] = ""
+		}
+	}
+
+	return filter, nil
+}
+
+// listCallsHandler lists calls a page at a time, or as newline delimited
+// JSON with format=ndjson, which has no limit unless one is given.
+func listCallsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter, err := parseCallFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var after *CallRecord
+	if cursor := query.Get("cursor"); cursor != "" {
+		if after, err = parseCallCursor(cursor); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ndjson := query.Get("format") == "ndjson"
+
+	limit := 100
+	if ndjson {
+		limit = 0
+	}
+	if param := query.Get("limit"); param != "" {
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit < 1 || limit > 1000 && !ndjson {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	calls := history.list(filter, after, limit)
+
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		for _, call := range calls {
+			if err := encoder.Encode(call); err != nil {
+				log.Println("failed to write response:", err)
+				return
+			}
+		}
+		return
+	}
+
+	list := CallList{Calls: calls}
+	if limit > 0 && len(calls) == limit {
+		list.NextCursor = callCursor(calls[len(calls)-1])
+	}
+	writeJSON(w, list)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor"
+)
+
+const (
+	callStatusSubmitting = "submitting"
+	callStatusDelayed    = "delayed"
+	callStatusWaiting    = "waiting"
+	callStatusQueued     = "queued"
+	callStatusPending    = "pending"
+	callStatusSucceeded  = "succeeded"
+	callStatusFailed     = "failed"
+	callStatusCancelled  = "cancelled"
+)
+
+var (
+	errIdempotencyMismatch = errors.New("idempotency key was already used with a different request")
+	errIdempotencyInFlight = errors.New("a request with this idempotency key is already being submitted")
+)
+
+type idempotencyRecord struct {
+	Function    string    `json:"function"`
+	Key         string    `json:"key"`
+	RequestHash string    `json:"request_hash"`
+	Guid        string    `json:"guid"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// idempotencyStore remembers the task started for each Idempotency-Key, so
+// that a client retrying a call gets the original task back instead of
+// starting a second one.
+type idempotencyStore struct {
+	sync.Mutex
+	ttl     time.Duration
+	records map[string]*idempotencyRecord
+	tasks   map[string]string
+}
+
+var idempotency = &idempotencyStore{
+	ttl:     24 * time.Hour,
+	records: map[string]*idempotencyRecord{},
+	tasks:   map[string]string{},
+}
+
+func idempotencyID(function, key string) string {
+	sum := sha256.Sum256([]byte(function + "\x00" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+func idempotencyPath(id string) string {
+	return filepath.Join("idempotency", id+".json")
+}
+
+func requestHash(v interface{}) string {
+	data, _ := json.Marshal(v)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *idempotencyStore) load() error {
+	s.Lock()
+	defer s.Unlock()
+
+	return loadJSONDir("idempotency", func(path string) error {
+		record := &idempotencyRecord{}
+		if err := loadJSON(path, record); err != nil {
+			return err
+		}
+		id := idempotencyID(record.Function, record.Key)
+		s.records[id] = record
+		s.tasks[record.Guid] = id
+		return nil
+	})
+}
+
+// reserve claims key for a new call, which will run as the task guid, or
+// returns the record of the call that already used it. Only a nil record
+// means the caller should start a task. The guid is known from here on, so
+// that a task that completes before commit is still seen.
+func (s *idempotencyStore) reserve(function, key, hash, guid string) (*idempotencyRecord, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	id := idempotencyID(function, key)
+	if record, ok := s.records[id]; ok && time.Since(record.CreatedAt) < s.ttl {
+		if record.RequestHash != hash {
+			return nil, errIdempotencyMismatch
+		}
+		if record.Status == callStatusSubmitting {
+			return nil, errIdempotencyInFlight
+		}
+		copied := *record
+		return &copied, nil
+	}
+
+	s.records[id] = &idempotencyRecord{
+		Function:    function,
+		Key:         key,
+		RequestHash: hash,
+		Guid:        guid,
+		Status:      callStatusSubmitting,
+		CreatedAt:   time.Now(),
+	}
+	s.tasks[guid] = id
+
+	return nil, nil
+}
+
+// commit records the status the call was given when it was submitted,
+// unless it has already completed.
+func (s *idempotencyStore) commit(function, key, status string) {
+	s.Lock()
+	defer s.Unlock()
+
+	id := idempotencyID(function, key)
+	record := s.records[id]
+	if record.Status == callStatusSubmitting {
+		record.Status = status
+	}
+
+	if err := saveJSON(idempotencyPath(id), record); err != nil {
+		log.Println("failed to save idempotency record:", err)
+	}
+}
+
+func (s *idempotencyStore) release(function, key string) {
+	s.Lock()
+	defer s.Unlock()
+
+	id := idempotencyID(function, key)
+	if record, ok := s.records[id]; ok {
+		delete(s.tasks, record.Guid)
+	}
+	delete(s.records, id)
+}
+
+func (s *idempotencyStore) taskCompleted(task receptor.TaskResponse) {
+	s.Lock()
+	defer s.Unlock()
+
+	id, ok := s.tasks[task.TaskGuid]
+	if !ok {
+		return
+	}
+	record := s.records[id]
+
+	record.Status = callStatusSucceeded
+	if task.Failed {
+		record.Status = callStatusFailed
+	}
+
+	if err := saveJSON(idempotencyPath(id), record); err != nil {
+		log.Println("failed to save idempotency record:", err)
+	}
+}
+
+func (s *idempotencyStore) purge() {
+	s.Lock()
+	defer s.Unlock()
+
+	for id, record := range s.records {
+		if record.Status == callStatusSubmitting || time.Since(record.CreatedAt) < s.ttl {
+			continue
+		}
+		delete(s.records, id)
+		delete(s.tasks, record.Guid)
+		if err := os.Remove(idempotencyPath(id)); err != nil && !os.IsNotExist(err) {
+			log.Println("failed to remove idempotency record:", err)
+		}
+	}
+}
+
+func (s *idempotencyStore) purgeEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.purge()
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor"
+)
+
+func TestIdempotencyStore(t *testing.T) {
+	reserve := func(s *idempotencyStore) {
+		if record, err := s.reserve("fn", "key", "hash", "task"); record != nil || err != nil {
+			t.Fatalf("first reserve returned %v, %v", record, err)
+		}
+	}
+	complete := func(s *idempotencyStore, failed bool) {
+		s.taskCompleted(receptor.TaskResponse{TaskGuid: "task", Failed: failed})
+	}
+
+	for _, test := range []struct {
+		name  string
+		setup func(s *idempotencyStore)
+		hash  string
+		// status is that of the record a repeat gets back, if any.
+		status string
+		err    error
+	}{
+		{
+			name:  "starts a call for a new key",
+			setup: func(s *idempotencyStore) {},
+			hash:  "hash",
+		},
+		{
+			name:  "rejects a repeat while the call is being submitted",
+			setup: reserve,
+			hash:  "hash",
+			err:   errIdempotencyInFlight,
+		},
+		{
+			name:  "rejects a repeat with a different request",
+			setup: reserve,
+			hash:  "other",
+			err:   errIdempotencyMismatch,
+		},
+		{
+			name: "returns the status the call was submitted with",
+			setup: func(s *idempotencyStore) {
+				reserve(s)
+				s.commit("fn", "key", callStatusQueued)
+			},
+			hash:   "hash",
+			status: callStatusQueued,
+		},
+		{
+			name: "returns the outcome once the call completes",
+			setup: func(s *idempotencyStore) {
+				reserve(s)
+				s.commit("fn", "key", callStatusPending)
+				complete(s, true)
+			},
+			hash:   "hash",
+			status: callStatusFailed,
+		},
+		{
+			name: "keeps an outcome that arrives before the commit",
+			setup: func(s *idempotencyStore) {
+				reserve(s)
+				complete(s, false)
+				s.commit("fn", "key", callStatusPending)
+			},
+			hash:   "hash",
+			status: callStatusSucceeded,
+		},
+		{
+			name: "starts a call for a released key",
+			setup: func(s *idempotencyStore) {
+				reserve(s)
+				s.release("fn", "key")
+			},
+			hash: "hash",
+		},
+	} {
+		s := &idempotencyStore{
+			ttl:     time.Hour,
+			records: map[string]*idempotencyRecord{},
+			tasks:   map[string]string{},
+		}
+		test.setup(s)
+
+		record, err := s.reserve("fn", "key", test.hash, "repeat")
+		if err != test.err {
+			t.Errorf("%s: reserve returned %v, expected %v", test.name, err, test.err)
+			continue
+		}
+		switch {
+		case test.status == "" && record != nil:
+			t.Errorf("%s: got a %s record, expected to start a call", test.name, record.Status)
+		case test.status != "" && record == nil:
+			t.Errorf("%s: started a call, expected a %s record", test.name, test.status)
+		case record != nil && (record.Status != test.status || record.Guid != "task"):
+			t.Errorf("%s: got %s for %s, expected %s for task", test.name, record.Status, record.Guid, test.status)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// imageAllowlist holds the rootfs prefixes that functions may use as their
+// own image, from the comma separated IMAGE_ALLOWLIST, e.g.
+// "docker:///myorg/,docker://registry.example.com/". With no allowlist,
+// functions can only use their runtime's rootfs.
+var imageAllowlist []string
+
+func parseImageAllowlist(value string) []string {
+	allowlist := []string{}
+	for _, prefix := range strings.Split(value, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			allowlist = append(allowlist, prefix)
+		}
+	}
+	return allowlist
+}
+
+func validImage(image string) error {
+	if !strings.HasPrefix(image, "docker://") {
+		return fmt.Errorf("image must be a docker:// rootfs: %s", image)
+	}
+	for _, prefix := range imageAllowlist {
+		if strings.HasPrefix(image, prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("image is not allowed: %s", image)
+}
+
+// ImageFunction is registered instead of a tarball for functions that are
+// just an image and the command to run in it.
+type ImageFunction struct {
+	Image   string `json:"image"`
+	Command string `json:"command"`
+	Type    string `json:"type,omitempty"`
+}
+
+func registerImageFunction(w http.ResponseWriter, r *http.Request, name string) {
+	var f ImageFunction
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.Image == "" || f.Command == "" {
+		http.Error(w, "image functions need an image and a command", http.StatusBadRequest)
+		return
+	}
+
+	old := configs.get(name)
+	config := old
+	config.Runtime = ""
+	config.NodeVersion = ""
+	config.Entrypoints = nil
+	config.Image = f.Image
+	config.Command = f.Command
+	hash := sha256.New()
+	io.WriteString(hash, f.Image+"\n"+f.Command)
+	config.Version = functionVersion(hash)
+	if f.Type != "" {
+		config.Type = f.Type
+		if config.Type != functionTypeHTTP {
+			config.HTTP = nil
+		}
+	}
+	if err := config.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := cells.checkStack(stackOf(config)); err != nil {
+		http.Error(w, err.Error(), stackErrorStatus(err))
+		return
+	}
+	if err := checkRoutes(name, config); err != nil {
+		http.Error(w, err.Error(), routeErrorStatus(err))
+		return
+	}
+
+	if err := configs.set(name, config); err != nil {
+		log.Println(err)
+		http.Error(w, "could not save function config", http.StatusInternalServerError)
+		return
+	}
+	if err := os.Remove(functionPath(name)); err != nil && !os.IsNotExist(err) {
+		log.Println("failed to remove function tarball:", err)
+	}
+
+	if err := deployFunction(name, old, config, true); err != nil {
+		log.Println("failed to deploy function:", err)
+		http.Error(w, "could not deploy function: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	io.WriteString(w, "registered function: "+name)
+}
+
+// statFunction reports whether the function has been registered, in the
+// manner of os.Stat.
+func statFunction(name string) error {
+	if configs.get(name).Command != "" {
+		return nil
+	}
+	_, err := os.Stat(functionPath(name))
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/cloudfoundry-incubator/runtime-schema/models"
+)
+
+// defaultResourceLimits are the operator's limits for every function's
+// install and run actions, given as JSON in DEFAULT_RESOURCE_LIMITS, e.g.
+// {"nofile": 1024}. Functions can override each limit in their
+// configuration. Diego only supports limiting open files.
+var defaultResourceLimits models.ResourceLimits
+
+func validResourceLimits(limits *models.ResourceLimits) error {
+	if limits != nil && limits.Nofile != nil && *limits.Nofile == 0 {
+		return errors.New("nofile limit must be positive")
+	}
+	return nil
+}
+
+func parseResourceLimits(value string) (models.ResourceLimits, error) {
+	var limits models.ResourceLimits
+	if err := json.Unmarshal([]byte(value), &limits); err != nil {
+		return limits, err
+	}
+	return limits, validResourceLimits(&limits)
+}
+
+func (config FunctionConfig) nofile() uint64 {
+	if config.ResourceLimits == nil || config.ResourceLimits.Nofile == nil {
+		return 0
+	}
+	return *config.ResourceLimits.Nofile
+}
+
+// resourceLimits works out the limits for the function's actions, taking
+// each from the function's configuration if it sets it, and from the
+// operator's defaults otherwise.
+func resourceLimits(function string) models.ResourceLimits {
+	limits := defaultResourceLimits
+	if override := configs.get(function).ResourceLimits; override != nil {
+		if override.Nofile != nil {
+			limits.Nofile = override.Nofile
+		}
+	}
+	return limits
+}
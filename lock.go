@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/cloudfoundry-incubator/receptor"
+)
+
+const (
+	lockPolicyQueue = "queue"
+	lockPolicySkip  = "skip"
+)
+
+var errLocked = errors.New("a call holding this lock key is already running")
+
+func validLockPolicy(policy string) error {
+	switch policy {
+	case "", lockPolicyQueue, lockPolicySkip:
+		return nil
+	}
+	return fmt.Errorf("unknown lock policy: %s", policy)
+}
+
+type lockWaiter struct {
+	Function string                     `json:"function"`
+	Priority string                     `json:"priority"`
+	Request  receptor.TaskCreateRequest `json:"request"`
+}
+
+type executionLock struct {
+	Key     string       `json:"key"`
+	Holder  string       `json:"holder"`
+	Waiting []lockWaiter `json:"waiting"`
+}
+
+func lockPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join("locks", hex.EncodeToString(sum[:])+".json")
+}
+
+// lockManager lets only one call per lock key run at a time. Later calls with
+// the same key wait their turn, and are handed to admission when the task
+// holding the lock completes.
+type lockManager struct {
+	sync.Mutex
+	locks map[string]*executionLock
+	tasks map[string]string
+}
+
+var locks = &lockManager{
+	locks: map[string]*executionLock{},
+	tasks: map[string]string{},
+}
+
+func (m *lockManager) load() error {
+	// Waiters that fail to submit are completed once the lock is released,
+	// as completing them comes back to the lock manager.
+	var failed []receptor.TaskResponse
+	defer func() {
+		for _, task := range failed {
+			taskCompleted(task)
+		}
+	}()
+
+	m.Lock()
+	defer m.Unlock()
+
+	err := loadJSONDir("locks", func(path string) error {
+		l := &executionLock{}
+		if err := loadJSON(path, l); err != nil {
+			return err
+		}
+		m.locks[l.Key] = l
+		m.tasks[l.Holder] = l.Key
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, l := range m.locks {
+		if admission.isQueued(l.Holder) {
+			continue
+		}
+
+		task, err := client.GetTask(l.Holder)
+		if rerr, ok := err.(receptor.Error); ok && rerr.Type == receptor.TaskNotFound {
+			failed = append(failed, m.release(l)...)
+			continue
+		}
+		if err != nil {
+			log.Println("failed to look up lock holder:", l.Holder, err)
+			continue
+		}
+		if task.State == receptor.TaskStateCompleted {
+			failed = append(failed, m.release(l)...)
+		}
+	}
+
+	return nil
+}
+
+// acquire submits request if nothing holds key. Otherwise it is either
+// refused, or held back until the lock is free, depending on policy.
+func (m *lockManager) acquire(key, policy, function, priority string, request receptor.TaskCreateRequest) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if l, held := m.locks[key]; held {
+		if policy == lockPolicySkip {
+			return "", errLocked
+		}
+
+		l.Waiting = append(l.Waiting, lockWaiter{
+			Function: function,
+			Priority: priority,
+			Request:  request,
+		})
+		if err := saveJSON(lockPath(key), l); err != nil {
+			l.Waiting = l.Waiting[:len(l.Waiting)-1]
+			return "", err
+		}
+		return callStatusWaiting, nil
+	}
+
+	queued, err := admission.submit(function, priority, request)
+	if err != nil {
+		return "", err
+	}
+
+	l := &executionLock{Key: key, Holder: request.TaskGuid}
+	m.locks[key] = l
+	m.tasks[request.TaskGuid] = key
+	if err := saveJSON(lockPath(key), l); err != nil {
+		log.Println("failed to save lock:", err)
+	}
+
+	if queued {
+		return callStatusQueued, nil
+	}
+	return callStatusPending, nil
+}
+
+func (m *lockManager) taskCompleted(task receptor.TaskResponse) {
+	m.Lock()
+	key, ok := m.tasks[task.TaskGuid]
+	if !ok {
+		m.Unlock()
+		return
+	}
+	failed := m.release(m.locks[key])
+	m.Unlock()
+
+	for _, task := range failed {
+		taskCompleted(task)
+	}
+}
+
+// release hands the lock to the next waiting call that can be submitted, or
+// drops it if there is none. Waiters that fail to submit are returned as
+// failed tasks, for the caller to complete once it has let go of m.
+func (m *lockManager) release(l *executionLock) []receptor.TaskResponse {
+	delete(m.tasks, l.Holder)
+
+	var failed []receptor.TaskResponse
+	for len(l.Waiting) > 0 {
+		next := l.Waiting[0]
+		l.Waiting = l.Waiting[1:]
+
+		if _, err := admission.submit(next.Function, next.Priority, next.Request); err != nil {
+			log.Println("failed to submit call waiting for lock:", next.Request.TaskGuid, err)
+			failed = append(failed, failedTask(next.Request, err.Error()))
+			continue
+		}
+
+		l.Holder = next.Request.TaskGuid
+		m.tasks[l.Holder] = l.Key
+		if err := saveJSON(lockPath(l.Key), l); err != nil {
+			log.Println("failed to save lock:", err)
+		}
+		return failed
+	}
+
+	delete(m.locks, l.Key)
+	if err := os.Remove(lockPath(l.Key)); err != nil && !os.IsNotExist(err) {
+		log.Println("failed to remove lock:", err)
+	}
+	return failed
+}
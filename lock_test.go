@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/cloudfoundry-incubator/receptor"
+)
+
+func TestLockRelease(t *testing.T) {
+	defer func() {
+		locks = &lockManager{locks: map[string]*executionLock{}, tasks: map[string]string{}}
+	}()
+
+	for _, test := range []struct {
+		name    string
+		waiting []string
+		// rejected waiters fail to submit.
+		rejected []string
+		holder   string
+		left     []string
+	}{
+		{
+			name: "drops a lock nothing waits for",
+		},
+		{
+			name:    "hands the lock to the next waiter",
+			waiting: []string{"first", "second"},
+			holder:  "first",
+			left:    []string{"second"},
+		},
+		{
+			name:     "passes over a waiter that fails to submit",
+			waiting:  []string{"first", "second"},
+			rejected: []string{"first"},
+			holder:   "second",
+		},
+		{
+			name:     "drops the lock when every waiter fails to submit",
+			waiting:  []string{"first", "second"},
+			rejected: []string{"first", "second"},
+		},
+	} {
+		fake := useFakeReceptor()
+		fake.createErr = func(guid string) error {
+			if contains(test.rejected, guid) {
+				return errors.New("receptor is down")
+			}
+			return nil
+		}
+
+		l := &executionLock{Key: "deploy", Holder: "holder"}
+		for _, guid := range test.waiting {
+			l.Waiting = append(l.Waiting, lockWaiter{Function: "fn", Request: testRequest("fn", guid)})
+			history.submitted(guid, "fn", FunctionCall{}, callStatusWaiting)
+		}
+		locks = &lockManager{
+			locks: map[string]*executionLock{"deploy": l},
+			tasks: map[string]string{"holder": "deploy"},
+		}
+
+		// A waiter that fails is completed through taskCompleted, which
+		// comes back to the lock manager, so this hangs if it is still held.
+		locks.taskCompleted(receptor.TaskResponse{TaskGuid: "holder"})
+
+		held, ok := locks.locks["deploy"]
+		switch {
+		case test.holder == "" && ok:
+			t.Errorf("%s: lock is still held by %s", test.name, held.Holder)
+		case test.holder != "" && !ok:
+			t.Errorf("%s: lock was dropped, expected %s to hold it", test.name, test.holder)
+		case ok:
+			var left []string
+			for _, waiter := range held.Waiting {
+				left = append(left, waiter.Request.TaskGuid)
+			}
+			if held.Holder != test.holder || !reflect.DeepEqual(left, test.left) {
+				t.Errorf("%s: held by %s with %v waiting, expected %s with %v", test.name, held.Holder, left, test.holder, test.left)
+			}
+		}
+
+		for _, guid := range test.rejected {
+			if record, _ := history.get(guid); record.Status != callStatusFailed {
+				t.Errorf("%s: %s is %s, expected %s", test.name, guid, record.Status, callStatusFailed)
+			}
+		}
+	}
+}
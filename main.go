@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,6 +9,9 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"code.google.com/p/go-uuid/uuid"
 
@@ -20,11 +24,30 @@ import (
 var client receptor.Client
 
 type FunctionCall struct {
-	Env []models.EnvironmentVariable `json:"env"`
+	Env        []models.EnvironmentVariable `json:"env"`
+	Priority   string                       `json:"priority,omitempty"`
+	LockKey    string                       `json:"lock_key,omitempty"`
+	LockPolicy string                       `json:"lock_policy,omitempty"`
+	Payload    json.RawMessage              `json:"payload,omitempty"`
+	RunAt      *time.Time                   `json:"run_at,omitempty"`
+	Delay      string                       `json:"delay,omitempty"`
+	Entry      string                       `json:"entry,omitempty"`
+	// Caller is set by gamma, to whatever made the call.
+	Caller string            `json:"caller,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func (call FunctionCall) env() []models.EnvironmentVariable {
+	env := append([]models.EnvironmentVariable{}, call.Env...)
+	if len(call.Payload) > 0 {
+		env = append(env, models.EnvironmentVariable{Name: "GAMMA_PAYLOAD", Value: string(call.Payload)})
+	}
+	return env
 }
 
 type FunctionCallResponse struct {
-	Guid string `json:"guid"`
+	Guid   string `json:"guid"`
+	Status string `json:"status,omitempty"`
 }
 
 func functionPath(name string) string {
@@ -41,6 +64,12 @@ func address() string {
 
 func registrationHandler(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Query().Get(":name")
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		registerImageFunction(w, r, name)
+		return
+	}
+
 	tarball, _, err := r.FormFile("tarball")
 	if err != nil {
 		http.Error(w, "no script", http.StatusBadRequest)
@@ -49,18 +78,83 @@ func registrationHandler(w http.ResponseWriter, r *http.Request) {
 	defer tarball.Close()
 
 	path := functionPath(name)
-	output, err := os.Create(path)
+	upload := path + ".upload"
+	output, err := os.Create(upload)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "could not create function tarball", http.StatusInternalServerError)
 		return
 	}
-	defer output.Close()
+	defer os.Remove(upload)
 
-	_, err = io.Copy(output, tarball)
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(output, hash), tarball)
+	output.Close()
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "could not copy function tarball", http.StatusInternalServerError)
+		return
+	}
+
+	old := configs.get(name)
+	config := old
+	config.Version = functionVersion(hash)
+	config.Command = ""
+	if image := r.FormValue("image"); image != "" {
+		config.Image = image
+	}
+	config.Runtime = r.FormValue("runtime")
+	if config.Runtime == "" {
+		if config.Runtime, err = detectRuntime(upload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if config.Entrypoints, err = packageEntrypoints(upload, config.Runtime); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	config.NodeVersion = ""
+	if config.Runtime == "node" {
+		if config.NodeVersion, err = packageNodeVersion(upload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if functionType := r.FormValue("type"); functionType != "" {
+		config.Type = functionType
+		if config.Type != functionTypeHTTP {
+			config.HTTP = nil
+		}
+	}
+	if err := config.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := cells.checkStack(stackOf(config)); err != nil {
+		http.Error(w, err.Error(), stackErrorStatus(err))
+		return
+	}
+	if err := checkRoutes(name, config); err != nil {
+		http.Error(w, err.Error(), routeErrorStatus(err))
+		return
+	}
+
+	if err := os.Rename(upload, path); err != nil {
+		log.Println(err)
+		http.Error(w, "could not save function tarball", http.StatusInternalServerError)
+		return
+	}
+	if err := configs.set(name, config); err != nil {
+		log.Println(err)
+		http.Error(w, "could not save function config", http.StatusInternalServerError)
+		return
+	}
+
+	if err := deployFunction(name, old, config, true); err != nil {
+		log.Println("failed to deploy function:", err)
+		http.Error(w, "could not deploy function: "+err.Error(), http.StatusBadGateway)
+		return
 	}
 
 	io.WriteString(w, "registered function: "+name)
@@ -75,8 +169,7 @@ func getFunctionHandler(w http.ResponseWriter, r *http.Request) {
 func callHandler(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Query().Get(":name")
 
-	path := functionPath(name)
-	if _, err := os.Stat(path); err != nil {
+	if err := statFunction(name); err != nil {
 		http.Error(w, "could not find function", http.StatusNotFound)
 		return
 	}
@@ -87,80 +180,363 @@ func callHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if entry := r.URL.Query().Get(":entry"); entry != "" {
+		call.Entry = entry
+	}
+
+	if err := validEnv(call.Env); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validPriority(call.Priority); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validLabels(call.Labels); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validLockPolicy(call.LockPolicy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, _, err := call.dueAt(time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Query().Get("dry_run") == "true" {
+		request, err := dryRunCall(name, call)
+		switch err {
+		case nil:
+			writeJSON(w, request)
+		case errHTTPFunction:
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errUnknownEntrypoint:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	guid := uuid.NewUUID().String()
+	key := r.Header.Get("Idempotency-Key")
+	if key != "" {
+		record, err := idempotency.reserve(name, key, requestHash(call), guid)
+		switch err {
+		case nil:
+		case errIdempotencyMismatch:
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		if record != nil {
+			writeJSON(w, FunctionCallResponse{Guid: record.Guid, Status: record.Status})
+			return
+		}
+	}
+
+	call.Caller = httpCaller(r)
+	response, err := submitCall(guid, name, call)
+	if err != nil {
+		if key != "" {
+			idempotency.release(name, key)
+		}
+		http.Error(w, err.Error(), callErrorStatus(err))
+		return
+	}
+
+	if key != "" {
+		idempotency.commit(name, key, response.Status)
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		message := fmt.Sprintf("failed to write response: %s", err.Error())
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-type", "application/json")
+}
+
+// callErrorStatus is the HTTP status for a call that could not be made.
+func callErrorStatus(err error) int {
+	switch err {
+	case errQueueFull:
+		return http.StatusTooManyRequests
+	case errLocked, errHTTPFunction:
+		return http.StatusConflict
+	case errUnknownEntrypoint:
+		return http.StatusNotFound
+	}
+	if _, ok := err.(unavailableStackError); ok {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func callFunction(name string, call FunctionCall) (FunctionCallResponse, error) {
+	return submitCall(uuid.NewUUID().String(), name, call)
+}
+
+// submitCall runs call as the task guid, now or when it is due.
+func submitCall(guid, name string, call FunctionCall) (FunctionCallResponse, error) {
+	if configs.get(name).Type == functionTypeHTTP {
+		return FunctionCallResponse{}, errHTTPFunction
+	}
+
+	if err := validEntrypoint(name, call.Entry); err != nil {
+		return FunctionCallResponse{}, err
+	}
+
+	if err := cells.checkStack(stackFor(name)); err != nil {
+		return FunctionCallResponse{}, err
+	}
+
+	runAt, later, err := call.dueAt(time.Now())
+	if err != nil {
+		return FunctionCallResponse{}, err
+	}
+	if later {
+		if err := delayed.hold(guid, name, call, runAt); err != nil {
+			return FunctionCallResponse{}, err
+		}
+		history.submitted(guid, name, call, callStatusDelayed)
+		return FunctionCallResponse{Guid: guid, Status: callStatusDelayed}, nil
+	}
+
+	return startCall(guid, name, call)
+}
+
+func startCall(guid, name string, call FunctionCall) (FunctionCallResponse, error) {
+	if err := validEntrypoint(name, call.Entry); err != nil {
+		return FunctionCallResponse{}, err
+	}
+
+	secretEnv, envFile, err := secretDelivery(guid, name)
+	if err != nil {
+		return FunctionCallResponse{}, err
+	}
+
+	request := callRequest(guid, name, call, secretEnv, envFile)
+
+	if call.LockKey != "" {
+		status, err := locks.acquire(call.LockKey, call.LockPolicy, name, call.Priority, request)
+		if err != nil {
+			envFiles.revoke(guid)
+			return FunctionCallResponse{}, err
+		}
+		history.submitted(guid, name, call, status)
+		return FunctionCallResponse{Guid: guid, Status: status}, nil
+	}
+
+	queued, err := admission.submit(name, call.Priority, request)
+	if err != nil {
+		envFiles.revoke(guid)
+		return FunctionCallResponse{}, err
+	}
+
+	response := FunctionCallResponse{
+		Guid:   guid,
+		Status: callStatusPending,
+	}
+	if queued {
+		response.Status = callStatusQueued
+	}
+	history.submitted(guid, name, call, response.Status)
+
+	return response, nil
+}
+
+func callRequest(guid, name string, call FunctionCall, secretEnv []models.EnvironmentVariable, envFile string) receptor.TaskCreateRequest {
+	env := mergeEnv(configs.get(name).Env, call.env(), secretEnv)
+
+	annotation := taskAnnotation{Function: name, Entry: call.Entry}
+	action := functionActions(name, entrypoint(call.Entry), "/home/vcap", env, envFile)
+	return newTaskRequest(guid, runtimeFor(name), annotation, action)
+}
+
+// dryRunCall builds the task that call would run, without running it or
+// revealing any secrets.
+func dryRunCall(name string, call FunctionCall) (receptor.TaskCreateRequest, error) {
+	if configs.get(name).Type == functionTypeHTTP {
+		return receptor.TaskCreateRequest{}, errHTTPFunction
+	}
+	if err := validEntrypoint(name, call.Entry); err != nil {
+		return receptor.TaskCreateRequest{}, err
+	}
+
+	secretEnv, envFile, err := redactedSecretDelivery(name)
+	if err != nil {
+		return receptor.TaskCreateRequest{}, err
+	}
+
+	return callRequest(uuid.NewUUID().String(), name, call, secretEnv, envFile), nil
+}
+
+func callbackHandler(w http.ResponseWriter, r *http.Request) {
+	var task receptor.TaskResponse
+	if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	taskCompleted(task)
+}
+
+func taskCompleted(task receptor.TaskResponse) {
+	workflows.taskCompleted(task)
+	idempotency.taskCompleted(task)
+	admission.taskCompleted(task)
+	locks.taskCompleted(task)
+	events.taskCompleted(task)
+	envFiles.taskCompleted(task)
+	history.taskCompleted(task)
+}
+
+// functionActions downloads, installs and runs the function's entry in dir. If
+// envFile is set, it is fetched after the install and sourced just before
+// the function runs, so that its contents never appear in the task.
+func functionActions(name, entry, dir string, env []models.EnvironmentVariable, envFile string) models.Action {
+	runtime := runtimeFor(name)
+
 	downloadAction := &models.EmitProgressAction{
 		Action: &models.DownloadAction{
 			From: address() + "/function/" + name,
-			To:   "/home/vcap",
+			To:   dir,
 		},
 		StartMessage: "Starting download",
 	}
 
-	installAction := &models.EmitProgressAction{
-		Action: &models.RunAction{
-			Path:       "/usr/local/bin/npm",
-			Args:       []string{"install", "/home/vcap/package"},
-			Privileged: true,
-		},
-		StartMessage: "Starting install",
-	}
-
 	executeAction := &models.EmitProgressAction{
 		Action: &models.RunAction{
-			Path:       "node_modules/.bin/run",
-			Env:        call.Env,
-			Privileged: true,
+			Path:           "/bin/sh",
+			Args:           []string{"-c", runtime.runCommand(dir, entry, envFile != "")},
+			Env:            append(homeEnv(), env...),
+			ResourceLimits: resourceLimits(name),
+			Privileged:     privileged(name),
 		},
 		StartMessage: "Running",
 	}
 
-	serialAction := &models.SerialAction{
-		Actions: []models.Action{
-			downloadAction,
-			installAction,
-			executeAction,
-		},
+	actions := []models.Action{}
+	if !runtime.NoPackage {
+		actions = append(actions, downloadAction)
 	}
+	if install := runtime.installCommand(dir); install != "" {
+		actions = append(actions, &models.EmitProgressAction{
+			Action: &models.RunAction{
+				Path:           "/bin/sh",
+				Args:           []string{"-c", install},
+				Env:            homeEnv(),
+				ResourceLimits: resourceLimits(name),
+				Privileged:     privileged(name),
+			},
+			StartMessage: "Starting install",
+		})
+	}
+	if envFile != "" {
+		actions = append(actions, &models.DownloadAction{
+			From: envFile,
+			To:   dir + "/" + envFileDir,
+		})
+	}
+	actions = append(actions, executeAction)
 
-	guid := uuid.NewUUID().String()
-	taskCreateRequest := receptor.TaskCreateRequest{
+	return &models.SerialAction{
+		Actions: actions,
+	}
+}
+
+type taskAnnotation struct {
+	Function string `json:"function,omitempty"`
+	Entry    string `json:"entry,omitempty"`
+	Workflow string `json:"workflow,omitempty"`
+}
+
+func newTaskRequest(guid string, runtime Runtime, annotation taskAnnotation, action models.Action) receptor.TaskCreateRequest {
+	annotationJSON, _ := json.Marshal(annotation)
+
+	return receptor.TaskCreateRequest{
 		TaskGuid:              guid,
+		Annotation:            string(annotationJSON),
 		LogGuid:               "gamma",
 		Domain:                "gamma",
-		Stack:                 "lucid64",
-		RootFSPath:            "docker:///dockerfile/nodejs",
-		Action:                serialAction,
+		Stack:                 runtime.Stack,
+		RootFSPath:            runtime.RootFS,
+		EnvironmentVariables:  defaultEnv,
+		Action:                action,
 		CompletionCallbackURL: address() + "/callback",
 		LogSource:             "gamma:" + guid,
 	}
+}
 
-	if err := runTask(taskCreateRequest); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("failed to write response:", err)
 	}
+}
 
-	response := FunctionCallResponse{
-		Guid: guid,
+func runTask(request receptor.TaskCreateRequest) error {
+	envFiles.activate(request.TaskGuid)
+	request, err := envFiles.injectSecrets(request)
+	if err != nil {
+		return err
 	}
-
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		message := fmt.Sprintf("failed to write response: %s", err.Error())
-		http.Error(w, message, http.StatusInternalServerError)
-		return
+	if !pools.dispatch(request) {
+		if err := client.CreateTask(request); err != nil {
+			return err
+		}
 	}
-
-	w.Header().Add("Content-type", "application/json")
+	history.started(request.TaskGuid)
+	return nil
 }
 
-func callbackHandler(w http.ResponseWriter, r *http.Request) {
-	io.Copy(os.Stdout, r.Body)
+func intFromEnv(name string, value *int) {
+	if s := os.Getenv(name); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			log.Fatalf("invalid %s: %s", name, err)
+		}
+		*value = n
+	}
 }
 
-func runTask(request receptor.TaskCreateRequest) error {
-	return client.CreateTask(request)
+func durationFromEnv(name string, value *time.Duration) {
+	if s := os.Getenv(name); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			log.Fatalf("invalid %s: %s", name, err)
+		}
+		*value = d
+	}
 }
 
 func main() {
 	os.MkdirAll("functions", 0777)
+	os.MkdirAll("workflows", 0777)
+	os.MkdirAll("runs", 0777)
+	os.MkdirAll("idempotency", 0777)
+	os.MkdirAll("configs", 0777)
+	os.MkdirAll("queue", 0777)
+	os.MkdirAll("locks", 0777)
+	os.MkdirAll("schedules", 0777)
+	os.MkdirAll("delayed", 0777)
+	os.MkdirAll("triggers", 0777)
+	os.MkdirAll("subscriptions", 0777)
+	os.MkdirAll("scaling", 0777)
+	os.MkdirAll("secrets", 0700)
+	os.MkdirAll("envfiles", 0700)
+	os.MkdirAll("calls", 0777)
 
 	receptorAddress := os.Getenv("RECEPTOR")
 	if receptorAddress == "" {
@@ -168,12 +544,163 @@ func main() {
 	}
 	client = receptor.NewClient(receptorAddress)
 
+	if value := os.Getenv("DEFAULT_ENV"); value != "" {
+		env, err := parseDefaultEnv(value)
+		if err != nil {
+			log.Fatalln("invalid DEFAULT_ENV:", err)
+		}
+		defaultEnv = env
+	}
+
+	if value := os.Getenv("DEFAULT_RESOURCE_LIMITS"); value != "" {
+		limits, err := parseResourceLimits(value)
+		if err != nil {
+			log.Fatalln("invalid DEFAULT_RESOURCE_LIMITS:", err)
+		}
+		defaultResourceLimits = limits
+	}
+
+	if stack := os.Getenv("STACK"); stack != "" {
+		defaultStack = stack
+	}
+
+	imageAllowlist = parseImageAllowlist(os.Getenv("IMAGE_ALLOWLIST"))
+	if value := os.Getenv("NODE_VERSIONS"); value != "" {
+		versions, err := parseNodeVersions(value)
+		if err != nil {
+			log.Fatalln("invalid NODE_VERSIONS:", err)
+		}
+		nodeVersions = versions
+	}
+
+	durationFromEnv("IDEMPOTENCY_TTL", &idempotency.ttl)
+	if err := idempotency.load(); err != nil {
+		log.Fatalln(err)
+	}
+	go idempotency.purgeEvery(time.Minute)
+
+	if key := os.Getenv("SECRETS_KEY"); key != "" {
+		if err := secrets.configure(key); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if err := secrets.load(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := migrateTriggerSecrets(); err != nil && err != errSecretsDisabled {
+		log.Fatalln(err)
+	}
+
+	durationFromEnv("ENV_FILE_TTL", &envFiles.ttl)
+	if err := envFiles.load(); err != nil {
+		log.Fatalln(err)
+	}
+	go envFiles.purgeEvery(time.Minute)
+
+	if err := configs.load(); err != nil {
+		log.Fatalln(err)
+	}
+
+	intFromEnv("MAX_IN_FLIGHT", &admission.maxInFlight)
+	intFromEnv("MAX_QUEUED", &admission.maxQueued)
+	if err := admission.load(); err != nil {
+		log.Fatalln(err)
+	}
+
+	if err := locks.load(); err != nil {
+		log.Fatalln(err)
+	}
+
+	if err := schedules.load(); err != nil {
+		log.Fatalln(err)
+	}
+	go schedules.run()
+
+	if err := history.load(); err != nil {
+		log.Fatalln(err)
+	}
+	durationFromEnv("CALL_HISTORY_MAX_AGE", &history.maxAge)
+	intFromEnv("CALL_HISTORY_MAX_PER_FUNCTION", &history.maxPerFunction)
+	go history.purgeEvery(time.Minute)
+
+	if err := delayed.load(); err != nil {
+		log.Fatalln(err)
+	}
+	go delayed.run()
+
+	if natsURL := os.Getenv("NATS_URL"); natsURL != "" {
+		source, err := newNATSSource(natsURL)
+		if err != nil {
+			log.Fatalln("could not connect to NATS:", err)
+		}
+		events.sources["nats"] = source
+	}
+	if err := events.load(); err != nil {
+		log.Fatalln(err)
+	}
+	// Well inside JetStream's default ack wait of 30 seconds.
+	eventProgressInterval := 10 * time.Second
+	durationFromEnv("EVENT_PROGRESS_INTERVAL", &eventProgressInterval)
+	go events.progressEvery(eventProgressInterval)
+
+	if err := workflows.load(); err != nil {
+		log.Fatalln(err)
+	}
+
+	if routeDomain == "" {
+		routeDomain = defaultRouteDomain()
+	}
+
+	durationFromEnv("AUTOSCALE_INTERVAL", &autoscale.interval)
+	durationFromEnv("WARM_INVOCATION_TIMEOUT", &pools.client.Timeout)
+	go autoscale.run()
+
 	pat := pat.New()
 
+	pat.Get("/workflow/{name}/runs/{guid}", http.HandlerFunc(getWorkflowRunHandler))
+	pat.Get("/workflow/{name}/runs", http.HandlerFunc(listWorkflowRunsHandler))
+	pat.Post("/workflow/{name}/run", http.HandlerFunc(runWorkflowHandler))
+	pat.Put("/workflow/{name}", http.HandlerFunc(registerWorkflowHandler))
+	pat.Get("/workflow/{name}", http.HandlerFunc(getWorkflowHandler))
+
+	pat.Get("/schedules", http.HandlerFunc(listSchedulesHandler))
+	pat.Put("/schedule/{name}", http.HandlerFunc(putScheduleHandler))
+	pat.Get("/schedule/{name}", http.HandlerFunc(getScheduleHandler))
+	pat.Delete("/schedule/{name}", http.HandlerFunc(deleteScheduleHandler))
+
+	pat.Get("/subscriptions", http.HandlerFunc(listSubscriptionsHandler))
+	pat.Put("/subscription/{name}", http.HandlerFunc(putSubscriptionHandler))
+	pat.Delete("/subscription/{name}", http.HandlerFunc(deleteSubscriptionHandler))
+	pat.Post("/events/{subject}", http.HandlerFunc(publishEventHandler))
+
+	pat.Post("/hooks/{trigger}", http.HandlerFunc(hookHandler))
+	pat.Put("/trigger/{name}", http.HandlerFunc(putTriggerHandler))
+	pat.Get("/trigger/{name}", http.HandlerFunc(getTriggerHandler))
+	pat.Delete("/trigger/{name}", http.HandlerFunc(deleteTriggerHandler))
+
+	pat.Get("/secrets", http.HandlerFunc(listSecretsHandler))
+	pat.Put("/secret/{name}", http.HandlerFunc(putSecretHandler))
+	pat.Get("/secret/{name}", http.HandlerFunc(getSecretHandler))
+	pat.Delete("/secret/{name}", http.HandlerFunc(deleteSecretHandler))
+
+	pat.Get("/envfile/{token}", http.HandlerFunc(envFileHandler))
+
+	pat.Get("/delayed", http.HandlerFunc(listDelayedHandler))
+	pat.Delete("/delayed/{guid}", http.HandlerFunc(cancelDelayedHandler))
+
+	pat.Get("/function/{name}/status", http.HandlerFunc(functionStatusHandler))
+	pat.Get("/function/{name}/scaling", http.HandlerFunc(scalingHandler))
+	pat.Get("/function/{name}/config", http.HandlerFunc(getFunctionConfigHandler))
+	pat.Put("/function/{name}/config", http.HandlerFunc(putFunctionConfigHandler))
 	pat.Put("/function/{name}", http.HandlerFunc(registrationHandler))
 	pat.Get("/function/{name}", http.HandlerFunc(getFunctionHandler))
+	pat.Post("/function/{name}/{entry}/call", http.HandlerFunc(callHandler))
 	pat.Post("/function/{name}/call", http.HandlerFunc(callHandler))
 	pat.Post("/callback", http.HandlerFunc(callbackHandler))
+	pat.Get("/calls", http.HandlerFunc(listCallsHandler))
+	pat.Get("/call/{guid}", http.HandlerFunc(getCallHandler))
+	pat.Get("/admission", http.HandlerFunc(admissionHandler))
+	pat.Get("/admin/cells", http.HandlerFunc(cellsHandler))
 
 	http.Handle("/", pat)
 
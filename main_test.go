@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/cloudfoundry-incubator/receptor"
+)
+
+// TestMain runs the tests in a scratch directory laid out as main lays out
+// gamma's working directory, so that nothing they save lands in the repo.
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "gamma-test")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	for _, name := range []string{
+		"functions", "workflows", "runs", "idempotency", "configs", "queue",
+		"locks", "schedules", "delayed", "triggers", "subscriptions",
+		"scaling", "secrets", "envfiles", "calls",
+	} {
+		if err := os.MkdirAll(name, 0777); err != nil {
+			panic(err)
+		}
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// fakeReceptor records the tasks gamma creates, refusing those createErr
+// fails, and answers lookups from tasks. Calls it does not override panic on
+// the nil embedded client.
+type fakeReceptor struct {
+	receptor.Client
+
+	sync.Mutex
+	created   []receptor.TaskCreateRequest
+	tasks     map[string]receptor.TaskResponse
+	createErr func(guid string) error
+}
+
+// useFakeReceptor points gamma at a fresh fakeReceptor, and resets the
+// stores that hold on to tasks between tests.
+func useFakeReceptor() *fakeReceptor {
+	fake := &fakeReceptor{tasks: map[string]receptor.TaskResponse{}}
+	client = fake
+	cells = &cellInventory{}
+	admission = &admissionController{
+		maxQueued: 1000,
+		inFlight:  map[string]int{},
+		tasks:     map[string]string{},
+	}
+	history = &callHistory{records: map[string]*CallRecord{}}
+	return fake
+}
+
+func (f *fakeReceptor) CreateTask(request receptor.TaskCreateRequest) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.createErr != nil {
+		if err := f.createErr(request.TaskGuid); err != nil {
+			return err
+		}
+	}
+	f.created = append(f.created, request)
+	return nil
+}
+
+func (f *fakeReceptor) GetTask(guid string) (receptor.TaskResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	task, ok := f.tasks[guid]
+	if !ok {
+		return receptor.TaskResponse{}, receptor.Error{Type: receptor.TaskNotFound}
+	}
+	return task, nil
+}
+
+func (f *fakeReceptor) TasksByDomain(domain string) ([]receptor.TaskResponse, error) {
+	return nil, nil
+}
+
+func (f *fakeReceptor) Cells() ([]receptor.CellResponse, error) {
+	return []receptor.CellResponse{{CellID: "cell", Stack: defaultStack}}, nil
+}
+
+func (f *fakeReceptor) createdGuids() []string {
+	f.Lock()
+	defer f.Unlock()
+
+	guids := make([]string, len(f.created))
+	for i, request := range f.created {
+		guids[i] = request.TaskGuid
+	}
+	return guids
+}
+
+// testRequest is a task request for a call to function.
+func testRequest(function, guid string) receptor.TaskCreateRequest {
+	annotation, _ := json.Marshal(taskAnnotation{Function: function})
+	return receptor.TaskCreateRequest{TaskGuid: guid, Annotation: string(annotation)}
+}
+
+// registerTestFunction makes name look registered to statFunction.
+func registerTestFunction(t *testing.T, name string) {
+	if err := ioutil.WriteFile(filepath.Join("functions", name), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// natsSource is an EventSource backed by a NATS connection. Messages that
+// arrive with a reply subject, as JetStream push consumers send them, are
+// acked with "+ACK" and nacked with "-NAK", and "+WPI" resets their ack wait
+// while their calls run. Core NATS has no redelivery, so nacking a message
+// without a reply subject drops it.
+type natsSource struct {
+	conn *nats.Conn
+}
+
+// newNATSSource connects to the comma separated server URLs in rawurl. The
+// connection is retried forever once it has been made, and subscriptions are
+// restored when it comes back.
+func newNATSSource(rawurl string) (*natsSource, error) {
+	conn, err := nats.Connect(rawurl,
+		nats.Name("gamma"),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(time.Second),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Println("lost connection to NATS:", err)
+			}
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			log.Println("reconnected to NATS at", conn.ConnectedUrl())
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, sub *nats.Subscription, err error) {
+			log.Println("NATS error:", err)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &natsSource{conn: conn}, nil
+}
+
+func (s *natsSource) Subscribe(subject, group string, handler func(Message)) (Subscription, error) {
+	deliver := func(msg *nats.Msg) {
+		handler(Message{
+			ID:      uuid.NewUUID().String(),
+			Subject: msg.Subject,
+			Data:    msg.Data,
+			Token:   msg.Reply,
+		})
+	}
+
+	var sub *nats.Subscription
+	var err error
+	if group == "" {
+		sub, err = s.conn.Subscribe(subject, deliver)
+	} else {
+		sub, err = s.conn.QueueSubscribe(subject, group, deliver)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (s *natsSource) Ack(message Message) error {
+	if message.Token == "" {
+		return nil
+	}
+	return s.conn.Publish(message.Token, []byte("+ACK"))
+}
+
+func (s *natsSource) InProgress(message Message) error {
+	if message.Token == "" {
+		return nil
+	}
+	return s.conn.Publish(message.Token, []byte("+WPI"))
+}
+
+func (s *natsSource) Nack(message Message) error {
+	if message.Token == "" {
+		log.Println("dropping NATS message that cannot be redelivered:", message.Subject)
+		return nil
+	}
+	return s.conn.Publish(message.Token, []byte("-NAK"))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// nodeVersions maps the Node versions operators provide to the rootfs that
+// has each one, from the JSON object in NODE_VERSIONS.
+var nodeVersions = map[string]string{
+	"0.10.40": "docker:///dockerfile/nodejs",
+}
+
+func parseNodeVersions(value string) (map[string]string, error) {
+	versions := map[string]string{}
+	if err := json.Unmarshal([]byte(value), &versions); err != nil {
+		return nil, err
+	}
+	for version, rootFS := range versions {
+		if _, err := parseSemver(version); err != nil {
+			return nil, err
+		}
+		if rootFS == "" {
+			return nil, fmt.Errorf("no rootfs for node %s", version)
+		}
+	}
+	return versions, nil
+}
+
+// resolveNodeVersion picks the newest Node version that satisfies an
+// engines.node range.
+func resolveNodeVersion(constraint string) (string, error) {
+	r, err := parseSemverRange(constraint)
+	if err != nil {
+		return "", fmt.Errorf("invalid engines.node %q: %s", constraint, err)
+	}
+
+	available := []semver{}
+	names := map[semver]string{}
+	for name := range nodeVersions {
+		v, _ := parseSemver(name)
+		available = append(available, v)
+		names[v] = name
+	}
+	sort.Sort(sort.Reverse(semversByAge(available)))
+
+	for _, v := range available {
+		if r.matches(v) {
+			return names[v], nil
+		}
+	}
+
+	return "", fmt.Errorf("no available node version satisfies engines.node %q", constraint)
+}
+
+// packageNodeVersion resolves the engines.node of the package in the tarball
+// at path, or returns "" if it does not ask for a version.
+func packageNodeVersion(path string) (string, error) {
+	data, found, err := tarballFile(path, "package/package.json")
+	if err != nil || !found {
+		return "", err
+	}
+
+	var pkg struct {
+		Engines json.RawMessage `json:"engines"`
+	}
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return "", fmt.Errorf("invalid package.json: %s", err)
+	}
+
+	// Very old packages give engines as a list, which npm ignores too.
+	var engines map[string]string
+	if json.Unmarshal(pkg.Engines, &engines) != nil || engines["node"] == "" {
+		return "", nil
+	}
+
+	return resolveNodeVersion(engines["node"])
+}
+
+type semversByAge []semver
+
+func (s semversByAge) Len() int           { return len(s) }
+func (s semversByAge) Less(i, j int) bool { return s[i].compare(s[j]) < 0 }
+func (s semversByAge) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
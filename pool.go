@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/runtime-schema/models"
+)
+
+const runnerPort = 8080
+
+// runnerScript is the in-container runner for warm pools. It runs the
+// function once per POST to /invoke, one invocation at a time, and reports
+// the exit status and the contents of GAMMA_RESULT_FILE.
+const runnerScript = `
+var http = require('http');
+var fs = require('fs');
+var spawn = require('child_process').spawn;
+var busy = false;
+
+http.createServer(function (req, res) {
+  if (req.url === '/health') {
+    res.writeHead(200);
+    return res.end('ok');
+  }
+  if (req.method !== 'POST' || req.url !== '/invoke') {
+    res.writeHead(404);
+    return res.end();
+  }
+  if (busy) {
+    res.writeHead(503);
+    return res.end('busy');
+  }
+  busy = true;
+
+  var body = '';
+  req.on('data', function (chunk) { body += chunk; });
+  req.on('end', function () {
+    var done = function (status, result) {
+      busy = false;
+      res.writeHead(200, { 'Content-Type': 'application/json' });
+      res.end(JSON.stringify({ exit_status: status, result: result }));
+    };
+
+    var call;
+    try {
+      call = JSON.parse(body);
+    } catch (e) {
+      busy = false;
+      res.writeHead(400);
+      return res.end('invalid invocation');
+    }
+
+    var resultFile = '/tmp/result-' + call.guid + '.json';
+    var env = {};
+    Object.keys(process.env).forEach(function (name) { env[name] = process.env[name]; });
+    (call.env || []).forEach(function (v) { env[v.name] = v.value; });
+    env.GAMMA_RESULT_FILE = resultFile;
+
+    var child = spawn('/bin/sh', ['-c', process.env.RUN_COMMAND], { cwd: '/home/vcap', env: env, stdio: 'inherit' });
+    child.on('error', function () { done(127, ''); });
+    child.on('exit', function (status) {
+      var result = '';
+      try {
+        result = fs.readFileSync(resultFile, 'utf8');
+        fs.unlinkSync(resultFile);
+      } catch (e) {}
+      done(status, result);
+    });
+  });
+}).listen(process.env.PORT);
+`
+
+const monitorScript = `
+require('http').get('http://127.0.0.1:' + process.env.PORT + '/health', function (res) {
+  process.exit(res.statusCode === 200 ? 0 : 1);
+}).on('error', function () { process.exit(1); });
+`
+
+type WarmPoolConfig struct {
+	Instances int              `json:"instances"`
+	Autoscale *AutoscaleConfig `json:"autoscale,omitempty"`
+}
+
+func (config WarmPoolConfig) validate() error {
+	if config.Instances < 0 {
+		return errors.New("warm pool instances must not be negative")
+	}
+	if config.Autoscale != nil {
+		return config.Autoscale.validate()
+	}
+	return nil
+}
+
+func processGuid(name string) string {
+	return "gamma-" + name
+}
+
+type invocation struct {
+	Guid string                       `json:"guid"`
+	Env  []models.EnvironmentVariable `json:"env"`
+}
+
+type invocationResult struct {
+	ExitStatus int    `json:"exit_status"`
+	Result     string `json:"result"`
+}
+
+// warmPools runs functions as long-running processes, so that calls can skip
+// the download and install that every task has to do.
+type warmPools struct {
+	sync.Mutex
+	busy     map[string]string
+	calls    map[string]int
+	lastCall map[string]time.Time
+	client   *http.Client
+}
+
+var pools = &warmPools{
+	busy:     map[string]string{},
+	calls:    map[string]int{},
+	lastCall: map[string]time.Time{},
+	client:   &http.Client{Timeout: 15 * time.Minute},
+}
+
+// notInvokedError is an invocation that never reached the runner, or that
+// the runner refused, so the function did not run and the call can safely
+// run as a task instead.
+type notInvokedError struct {
+	err error
+}
+
+func (e notInvokedError) Error() string {
+	return e.err.Error()
+}
+
+var errWarmPoolRuntime = errors.New("warm pools are only available to node functions")
+
+// installAction downloads and installs the function into /home/vcap, ready
+// for a long-running process to run it.
+func installAction(name string) models.Action {
+	runtime := runtimeFor(name)
+
+	actions := []models.Action{}
+	if !runtime.NoPackage {
+		actions = append(actions, &models.DownloadAction{
+			From: address() + "/function/" + name,
+			To:   "/home/vcap",
+		})
+	}
+	if install := runtime.installCommand("/home/vcap"); install != "" {
+		actions = append(actions, &models.RunAction{
+			Path:           "/bin/sh",
+			Args:           []string{"-c", install},
+			Env:            homeEnv(),
+			ResourceLimits: resourceLimits(name),
+			Privileged:     privileged(name),
+		})
+	}
+	if len(actions) == 0 {
+		return nil
+	}
+	return models.Serial(actions...)
+}
+
+func (p *warmPools) desiredLRP(name string, config WarmPoolConfig) receptor.DesiredLRPCreateRequest {
+	runtime := runtimeFor(name)
+	portEnv := []models.EnvironmentVariable{{Name: "PORT", Value: fmt.Sprint(runnerPort)}}
+
+	return receptor.DesiredLRPCreateRequest{
+		ProcessGuid:          processGuid(name),
+		Domain:               "gamma",
+		RootFSPath:           runtime.RootFS,
+		Instances:            config.Instances,
+		Stack:                runtime.Stack,
+		EnvironmentVariables: defaultEnv,
+		Setup:                installAction(name),
+		Action: &models.RunAction{
+			Path: "/usr/local/bin/node",
+			Args: []string{"-e", runnerScript},
+			Env: append(append(portEnv, homeEnv()...), models.EnvironmentVariable{
+				Name:  "RUN_COMMAND",
+				Value: runtime.runCommand("/home/vcap", defaultEntrypoint, false),
+			}),
+			ResourceLimits: resourceLimits(name),
+			Privileged:     privileged(name),
+		},
+		Monitor: &models.RunAction{
+			Path: "/usr/local/bin/node",
+			Args: []string{"-e", monitorScript},
+			Env:  portEnv,
+		},
+		Ports:     []uint32{runnerPort},
+		LogGuid:   "gamma",
+		LogSource: "gamma:" + name,
+	}
+}
+
+// sync makes the function's DesiredLRP match its configuration, creating,
+// scaling or removing it as needed.
+func (p *warmPools) sync(name string, config *WarmPoolConfig) error {
+	if config != nil && runtimeFor(name).Name != "node" {
+		return errWarmPoolRuntime
+	}
+
+	_, err := client.GetDesiredLRP(processGuid(name))
+	exists := err == nil
+	if rerr, ok := err.(receptor.Error); err != nil && !(ok && rerr.Type == receptor.DesiredLRPNotFound) {
+		return err
+	}
+
+	switch {
+	case config == nil && exists:
+		return client.DeleteDesiredLRP(processGuid(name))
+	case config == nil:
+		return nil
+	case exists:
+		instances := config.Instances
+		return client.UpdateDesiredLRP(processGuid(name), receptor.DesiredLRPUpdateRequest{
+			Instances: &instances,
+		})
+	default:
+		return client.CreateDesiredLRP(p.desiredLRP(name, *config))
+	}
+}
+
+// restart replaces the function's DesiredLRP, so that its instances pick up
+// a newly registered tarball.
+func (p *warmPools) restart(name string, config *WarmPoolConfig) error {
+	if config == nil {
+		return nil
+	}
+	if runtimeFor(name).Name != "node" {
+		return errWarmPoolRuntime
+	}
+
+	err := client.DeleteDesiredLRP(processGuid(name))
+	if rerr, ok := err.(receptor.Error); err != nil && !(ok && rerr.Type == receptor.DesiredLRPNotFound) {
+		return err
+	}
+
+	return client.CreateDesiredLRP(p.desiredLRP(name, *config))
+}
+
+// claim picks an idle, running instance of the function's warm pool and
+// marks it busy. It returns false if there is none.
+func (p *warmPools) claim(name string) (receptor.ActualLRPResponse, bool) {
+	actuals, err := client.ActualLRPsByProcessGuid(processGuid(name))
+	if err != nil {
+		log.Println("failed to look up warm pool:", name, err)
+		return receptor.ActualLRPResponse{}, false
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	for _, actual := range actuals {
+		if _, busy := p.busy[actual.InstanceGuid]; busy || actual.State != receptor.ActualLRPStateRunning {
+			continue
+		}
+		for _, port := range actual.Ports {
+			if port.ContainerPort == runnerPort {
+				p.busy[actual.InstanceGuid] = name
+				return actual, true
+			}
+		}
+	}
+
+	return receptor.ActualLRPResponse{}, false
+}
+
+func (p *warmPools) recordCall(name string) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.calls[name]++
+	p.lastCall[name] = time.Now()
+}
+
+// usage returns the number of calls since it was last asked, when the last
+// call was, and how many instances are busy.
+func (p *warmPools) usage(name string) (int, time.Time, int) {
+	p.Lock()
+	defer p.Unlock()
+
+	calls := p.calls[name]
+	p.calls[name] = 0
+
+	busy := 0
+	for _, function := range p.busy {
+		if function == name {
+			busy++
+		}
+	}
+
+	return calls, p.lastCall[name], busy
+}
+
+func (p *warmPools) release(actual receptor.ActualLRPResponse) {
+	p.Lock()
+	defer p.Unlock()
+
+	delete(p.busy, actual.InstanceGuid)
+}
+
+// dispatch runs request on a warm instance if the function has one free,
+// and reports whether it did. The outcome is fed back through taskCompleted
+// as though a task had run.
+func (p *warmPools) dispatch(request receptor.TaskCreateRequest) bool {
+	var annotation taskAnnotation
+	json.Unmarshal([]byte(request.Annotation), &annotation)
+	if annotation.Function == "" || configs.get(annotation.Function).WarmPool == nil {
+		return false
+	}
+	if entrypoint(annotation.Entry) != defaultEntrypoint {
+		return false
+	}
+	p.recordCall(annotation.Function)
+
+	actual, ok := p.claim(annotation.Function)
+	if !ok {
+		return false
+	}
+
+	go func() {
+		defer p.release(actual)
+
+		secretEnv, err := envFiles.values(request.TaskGuid)
+		if err != nil {
+			taskCompleted(failedTask(request, err.Error()))
+			return
+		}
+
+		result, err := p.invoke(actual, invocation{
+			Guid: request.TaskGuid,
+			Env:  append(runEnv(request.Action), secretEnv...),
+		})
+		if _, ok := err.(notInvokedError); ok {
+			log.Println("warm invocation failed, falling back to a task:", request.TaskGuid, err)
+			if err := client.CreateTask(request); err != nil {
+				taskCompleted(failedTask(request, err.Error()))
+			}
+			return
+		}
+		if err != nil {
+			// The function may have run, so running it again as a task
+			// could repeat its side effects.
+			log.Println("warm invocation failed:", request.TaskGuid, err)
+			taskCompleted(failedTask(request, err.Error()))
+			return
+		}
+
+		task := completedTask(request)
+		task.Result = result.Result
+		if result.ExitStatus != 0 {
+			task.Failed = true
+			task.FailureReason = fmt.Sprintf("Exited with status %d", result.ExitStatus)
+		}
+		taskCompleted(task)
+	}()
+
+	return true
+}
+
+func (p *warmPools) invoke(actual receptor.ActualLRPResponse, call invocation) (invocationResult, error) {
+	var hostPort uint32
+	for _, port := range actual.Ports {
+		if port.ContainerPort == runnerPort {
+			hostPort = port.HostPort
+		}
+	}
+
+	body, _ := json.Marshal(call)
+	url := fmt.Sprintf("http://%s:%d/invoke", actual.Host, hostPort)
+	res, err := p.client.Post(url, "application/json", bytes.NewReader(body))
+	if uerr, ok := err.(*neturl.Error); ok {
+		if oerr, ok := uerr.Err.(*net.OpError); ok && oerr.Op == "dial" {
+			return invocationResult{}, notInvokedError{err}
+		}
+	}
+	if err != nil {
+		return invocationResult{}, err
+	}
+	defer res.Body.Close()
+
+	// The runner only answers with anything but 200 when it has not run the
+	// function, as when it is busy.
+	if res.StatusCode != http.StatusOK {
+		return invocationResult{}, notInvokedError{fmt.Errorf("runner responded with %s", res.Status)}
+	}
+
+	var result invocationResult
+	err = json.NewDecoder(res.Body).Decode(&result)
+	return result, err
+}
+
+// runEnv finds the environment of the last RunAction in action, which is
+// the one that runs the function.
+func runEnv(action models.Action) []models.EnvironmentVariable {
+	switch a := action.(type) {
+	case *models.RunAction:
+		return a.Env
+	case *models.EmitProgressAction:
+		return runEnv(a.Action)
+	case *models.TimeoutAction:
+		return runEnv(a.Action)
+	case *models.TryAction:
+		return runEnv(a.Action)
+	case *models.SerialAction:
+		for i := len(a.Actions) - 1; i >= 0; i-- {
+			if env := runEnv(a.Actions[i]); env != nil {
+				return env
+			}
+		}
+	}
+	return nil
+}
+
+func completedTask(request receptor.TaskCreateRequest) receptor.TaskResponse {
+	return receptor.TaskResponse{
+		TaskGuid:   request.TaskGuid,
+		Domain:     request.Domain,
+		Annotation: request.Annotation,
+		LogGuid:    request.LogGuid,
+		LogSource:  request.LogSource,
+		Action:     request.Action,
+		CreatedAt:  time.Now().UnixNano(),
+		State:      receptor.TaskStateCompleted,
+	}
+}
+
+func failedTask(request receptor.TaskCreateRequest, reason string) receptor.TaskResponse {
+	task := completedTask(request)
+	task.Failed = true
+	task.FailureReason = reason
+	return task
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/cloudfoundry-incubator/runtime-schema/models"
+)
+
+// adminToken lets operators do what function owners cannot, such as letting
+// a function run privileged. Admin requests carry it as a bearer token. With
+// no ADMIN_TOKEN set, there are no admins.
+var adminToken = os.Getenv("ADMIN_TOKEN")
+
+var errAdminOnly = errors.New("only admins can change whether a function runs privileged")
+
+func isAdmin(r *http.Request) bool {
+	if adminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// privileged reports whether the function's install and run actions should
+// be privileged. Functions run as the container's unprivileged user unless
+// an admin has said otherwise.
+func privileged(function string) bool {
+	return configs.get(function).Privileged
+}
+
+// homeEnv points HOME at the container user's home, where functions are
+// installed, so that package managers have somewhere writable for their
+// caches and user installs.
+func homeEnv() []models.EnvironmentVariable {
+	return []models.EnvironmentVariable{{Name: "HOME", Value: "/home/vcap"}}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Runtime knows how to install and run a function written for it. Commands
+// are shell commands run from the function's directory, into which the
+// tarball has been unpacked. Like npm pack, tarballs hold their files under
+// package/. In Run, {entry} stands for the entrypoint being called.
+type Runtime struct {
+	Name   string
+	RootFS string
+	// Stack is the cell stack the function runs on. It is set by runtimeFor.
+	Stack string
+	// Workdir is where Install and Run are run, relative to the function's
+	// directory.
+	Workdir string
+	Install string
+	Run     string
+	// PortCheck succeeds once something is listening on $PORT.
+	PortCheck string
+	// NoPackage is set for functions that are only an image and a command,
+	// which have nothing to download or install.
+	NoPackage bool
+}
+
+var runtimes = map[string]Runtime{
+	"node": {
+		Name:      "node",
+		RootFS:    "docker:///dockerfile/nodejs",
+		Install:   "/usr/local/bin/npm install ./package",
+		Run:       "node_modules/.bin/{entry}",
+		PortCheck: "/usr/local/bin/node -e \"require('net').connect(process.env.PORT, '127.0.0.1').on('connect', function () { process.exit(0); }).on('error', function () { process.exit(1); })\"",
+	},
+	"python": {
+		Name:      "python",
+		RootFS:    "docker:///library/python#2.7",
+		Workdir:   "package",
+		Install:   "if [ -f requirements.txt ]; then pip install --user -r requirements.txt; elif [ -f setup.py ]; then pip install --user .; fi",
+		Run:       "bin/{entry}",
+		PortCheck: "python -c \"import os, socket; socket.create_connection(('127.0.0.1', int(os.environ['PORT'])))\"",
+	},
+	"ruby": {
+		Name:      "ruby",
+		RootFS:    "docker:///library/ruby#2.2",
+		Workdir:   "package",
+		Install:   "bundle install --path vendor/bundle",
+		Run:       "bundle exec bin/{entry}",
+		PortCheck: "ruby -rsocket -e 'TCPSocket.new(\"127.0.0.1\", ENV[\"PORT\"])'",
+	},
+	"static": {
+		Name:      "static",
+		RootFS:    "docker:///library/busybox",
+		Workdir:   "package",
+		Install:   "chmod +x bin/*",
+		Run:       "bin/{entry}",
+		PortCheck: "nc -z 127.0.0.1 $PORT",
+	},
+	"shell": {
+		Name:      "shell",
+		RootFS:    "docker:///library/ubuntu#14.04",
+		Workdir:   "package",
+		Run:       "/bin/bash bin/{entry}",
+		PortCheck: "exec 3<>/dev/tcp/127.0.0.1/$PORT",
+	},
+}
+
+const defaultRuntime = "node"
+
+func validRuntime(name string) error {
+	if _, ok := runtimes[name]; name != "" && !ok {
+		return fmt.Errorf("unknown runtime: %s", name)
+	}
+	return nil
+}
+
+// runtimeFor looks up the function's runtime, with its own image if it has
+// one. Functions registered before there were runtimes are node packages.
+func runtimeFor(function string) Runtime {
+	config := configs.get(function)
+
+	runtime, ok := runtimes[config.Runtime]
+	if !ok {
+		runtime = runtimes[defaultRuntime]
+	}
+	if rootFS, ok := nodeVersions[config.NodeVersion]; ok && runtime.Name == "node" {
+		runtime.RootFS = rootFS
+	}
+	if config.Command != "" {
+		runtime = Runtime{
+			Name:      "image",
+			Run:       config.Command,
+			PortCheck: "nc -z 127.0.0.1 $PORT",
+			NoPackage: true,
+		}
+	}
+	if config.Image != "" {
+		runtime.RootFS = config.Image
+	}
+	runtime.Stack = stackFor(function)
+
+	return runtime
+}
+
+func (r Runtime) cd(dir string) string {
+	if r.Workdir == "" {
+		return "cd " + dir
+	}
+	return "cd " + dir + "/" + r.Workdir
+}
+
+// installCommand installs the function in dir, or is empty if the runtime
+// has nothing to install.
+func (r Runtime) installCommand(dir string) string {
+	if r.Install == "" || r.NoPackage {
+		return ""
+	}
+	return r.cd(dir) + " && " + r.Install
+}
+
+// runCommand runs the function's entry in dir. With an env file, the file
+// is sourced and removed first.
+func (r Runtime) runCommand(dir, entry string, envFile bool) string {
+	run := strings.Replace(r.Run, "{entry}", entry, -1)
+
+	command := r.cd(dir) + " && exec " + run
+	if r.NoPackage {
+		command = "exec " + run
+	}
+	command = writeVCAPServices(dir) + " && " + command
+	if envFile {
+		file := dir + "/" + envFileDir + "/env"
+		command = ". " + file + " && rm -f " + file + " && " + command
+	}
+	return command
+}
+
+// detectRuntime works out a function's runtime from the files in its
+// tarball.
+func detectRuntime(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return "", errors.New("function is not a gzipped tarball")
+	}
+
+	files := map[string]bool{}
+	var run []byte
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", errors.New("function is not a gzipped tarball")
+		}
+
+		name := strings.TrimPrefix(strings.TrimPrefix(header.Name, "./"), "package/")
+		files[name] = true
+		if name == "bin/run" {
+			run = make([]byte, 128)
+			n, _ := io.ReadFull(tr, run)
+			run = run[:n]
+		}
+	}
+
+	var interpreter string
+	if bytes.HasPrefix(run, []byte("#!")) {
+		interpreter = shebangInterpreter(run)
+	}
+
+	switch {
+	case files["package.json"]:
+		return "node", nil
+	case files["requirements.txt"], files["setup.py"]:
+		return "python", nil
+	case files["Gemfile"]:
+		return "ruby", nil
+	case bytes.HasPrefix(run, []byte("\x7fELF")):
+		return "static", nil
+	case interpreter == "sh" || interpreter == "bash":
+		return "shell", nil
+	case strings.HasPrefix(interpreter, "python"):
+		return "python", nil
+	}
+
+	return "", errors.New("could not detect the function's runtime; set one with the runtime form parameter")
+}
+
+// shebangInterpreter names the program a script's #! line runs, looking
+// through /usr/bin/env, e.g. python3 for "#!/usr/bin/env python3".
+func shebangInterpreter(script []byte) string {
+	line := string(script[2:])
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	interpreter := path.Base(fields[0])
+	if interpreter == "env" && len(fields) > 1 {
+		interpreter = path.Base(fields[1])
+	}
+	return interpreter
+}
+
+// tarballFile reads the named file out of a gzipped tarball, reporting false
+// if there is no such file.
+func tarballFile(path, name string) ([]byte, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, false, errors.New("function is not a gzipped tarball")
+	}
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, errors.New("function is not a gzipped tarball")
+		}
+
+		if strings.TrimPrefix(header.Name, "./") == name {
+			data, err := ioutil.ReadAll(tr)
+			return data, true, err
+		}
+	}
+}
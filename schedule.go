@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	overlapSkip  = "skip"
+	overlapQueue = "queue"
+	overlapAllow = "allow"
+)
+
+type Schedule struct {
+	Name     string       `json:"name"`
+	Function string       `json:"function"`
+	Cron     string       `json:"cron"`
+	Timezone string       `json:"timezone,omitempty"`
+	Call     FunctionCall `json:"call"`
+	Overlap  string       `json:"overlap,omitempty"`
+	Jitter   string       `json:"jitter,omitempty"`
+
+	NextRun   time.Time `json:"next_run"`
+	LastRun   time.Time `json:"last_run,omitempty"`
+	LastGuid  string    `json:"last_guid,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+
+	cron     *cronSchedule
+	location *time.Location
+	jitter   time.Duration
+}
+
+func schedulePath(name string) string {
+	return filepath.Join("schedules", name+".json")
+}
+
+// prepare validates the schedule and fills in the parsed cron expression,
+// timezone and jitter.
+func (s *Schedule) prepare() error {
+	if s.Function == "" {
+		return errors.New("schedule has no function")
+	}
+
+	var err error
+	if s.cron, err = parseCron(s.Cron); err != nil {
+		return err
+	}
+
+	if s.location, err = time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone: %s", s.Timezone)
+	}
+	if s.cron.next(time.Now().In(s.location)).IsZero() {
+		return fmt.Errorf("cron expression never matches: %q", s.Cron)
+	}
+
+	if s.Jitter != "" {
+		if s.jitter, err = time.ParseDuration(s.Jitter); err != nil || s.jitter < 0 {
+			return fmt.Errorf("invalid jitter: %s", s.Jitter)
+		}
+	}
+
+	switch s.Overlap {
+	case "":
+		s.Overlap = overlapAllow
+	case overlapSkip, overlapQueue, overlapAllow:
+	default:
+		return fmt.Errorf("unknown overlap policy: %s", s.Overlap)
+	}
+
+	if err := validLabels(s.Call.Labels); err != nil {
+		return err
+	}
+	if err := validEnv(s.Call.Env); err != nil {
+		return err
+	}
+
+	if s.Call.LockKey != "" && s.Overlap != overlapAllow {
+		return errors.New("a schedule cannot set lock_key unless overlap is allow")
+	}
+
+	if err := validPriority(s.Call.Priority); err != nil {
+		return err
+	}
+
+	if _, _, err := s.Call.dueAt(time.Now()); err != nil {
+		return err
+	}
+
+	return validLockPolicy(s.Call.LockPolicy)
+}
+
+func (s *Schedule) scheduleNext(after time.Time) {
+	s.NextRun = s.cron.next(after.In(s.location))
+}
+
+// call is the function call made on each run. Overlap between runs is
+// controlled with a lock key unique to the schedule.
+func (s *Schedule) call() FunctionCall {
+	call := s.Call
+	call.Caller = "schedule:" + s.Name
+	switch s.Overlap {
+	case overlapSkip:
+		call.LockKey = "schedule:" + s.Name
+		call.LockPolicy = lockPolicySkip
+	case overlapQueue:
+		call.LockKey = "schedule:" + s.Name
+		call.LockPolicy = lockPolicyQueue
+	}
+	return call
+}
+
+type scheduler struct {
+	sync.Mutex
+	schedules map[string]*Schedule
+}
+
+var schedules = &scheduler{
+	schedules: map[string]*Schedule{},
+}
+
+// load reads saved schedules. Runs that were due while gamma was stopped are
+// not made up; each schedule carries on from its next run after now.
+func (s *scheduler) load() error {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	return loadJSONDir("schedules", func(path string) error {
+		schedule := &Schedule{}
+		if err := loadJSON(path, schedule); err != nil {
+			return err
+		}
+		if err := schedule.prepare(); err != nil {
+			return fmt.Errorf("invalid schedule %s: %s", schedule.Name, err)
+		}
+		if schedule.NextRun.Before(now) {
+			schedule.scheduleNext(now)
+		}
+		s.schedules[schedule.Name] = schedule
+		return nil
+	})
+}
+
+func (s *scheduler) set(schedule *Schedule) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if existing, ok := s.schedules[schedule.Name]; ok {
+		schedule.LastRun = existing.LastRun
+		schedule.LastGuid = existing.LastGuid
+		schedule.LastError = existing.LastError
+	}
+	schedule.scheduleNext(time.Now())
+
+	if err := saveJSON(schedulePath(schedule.Name), schedule); err != nil {
+		return err
+	}
+	s.schedules[schedule.Name] = schedule
+
+	return nil
+}
+
+func (s *scheduler) get(name string) (Schedule, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	schedule, ok := s.schedules[name]
+	if !ok {
+		return Schedule{}, false
+	}
+	return *schedule, true
+}
+
+func (s *scheduler) list() []Schedule {
+	s.Lock()
+	defer s.Unlock()
+
+	list := []Schedule{}
+	for _, schedule := range s.schedules {
+		list = append(list, *schedule)
+	}
+	sort.Sort(schedulesByName(list))
+
+	return list
+}
+
+func (s *scheduler) remove(name string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.schedules[name]; !ok {
+		return false
+	}
+	delete(s.schedules, name)
+	if err := os.Remove(schedulePath(name)); err != nil {
+		log.Println("failed to remove schedule:", err)
+	}
+
+	return true
+}
+
+func (s *scheduler) run() {
+	for now := range time.Tick(time.Second) {
+		s.Lock()
+		for _, schedule := range s.schedules {
+			if schedule.NextRun.IsZero() || now.Before(schedule.NextRun) {
+				continue
+			}
+			schedule.scheduleNext(now)
+			if err := saveJSON(schedulePath(schedule.Name), schedule); err != nil {
+				log.Println("failed to save schedule:", err)
+			}
+			go s.fire(schedule.Name, schedule.Function, schedule.call(), schedule.jitter)
+		}
+		s.Unlock()
+	}
+}
+
+func (s *scheduler) fire(name, function string, call FunctionCall, jitter time.Duration) {
+	if jitter > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(jitter))))
+	}
+
+	var response FunctionCallResponse
+	err := statFunction(function)
+	if err != nil {
+		err = errors.New("could not find function")
+	} else {
+		response, err = callFunction(function, call)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	schedule, ok := s.schedules[name]
+	if !ok {
+		return
+	}
+
+	schedule.LastRun = time.Now()
+	schedule.LastGuid = response.Guid
+	schedule.LastError = ""
+	if err == errLocked {
+		schedule.LastError = "skipped: the previous run has not finished"
+	} else if err != nil {
+		log.Println("scheduled call failed:", name, err)
+		schedule.LastError = err.Error()
+	}
+
+	if err := saveJSON(schedulePath(name), schedule); err != nil {
+		log.Println("failed to save schedule:", err)
+	}
+}
+
+type schedulesByName []Schedule
+
+func (s schedulesByName) Len() int           { return len(s) }
+func (s schedulesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s schedulesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func putScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	schedule := &Schedule{}
+	if err := json.NewDecoder(r.Body).Decode(schedule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	schedule.Name = name
+
+	if err := schedule.prepare(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := statFunction(schedule.Function); err != nil {
+		http.Error(w, "could not find function", http.StatusNotFound)
+		return
+	}
+
+	if err := schedules.set(schedule); err != nil {
+		log.Println(err)
+		http.Error(w, "could not save schedule", http.StatusInternalServerError)
+		return
+	}
+
+	saved, _ := schedules.get(name)
+	writeJSON(w, saved)
+}
+
+func getScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	schedule, ok := schedules.get(name)
+	if !ok {
+		http.Error(w, "could not find schedule", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, schedule)
+}
+
+func listSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, schedules.list())
+}
+
+func deleteScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	if !schedules.remove(name) {
+		http.Error(w, "could not find schedule", http.StatusNotFound)
+		return
+	}
+
+	io.WriteString(w, "deleted schedule: "+name)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/runtime-schema/models"
+)
+
+var errSecretsDisabled = errors.New("secret store is not configured: SECRETS_KEY not set")
+
+// SecretRef asks for a secret to be put in a function's environment as Env.
+// A Version of 0 means the latest version.
+type SecretRef struct {
+	Secret  string `json:"secret"`
+	Env     string `json:"env"`
+	Version int    `json:"version,omitempty"`
+}
+
+type SecretInfo struct {
+	Name     string              `json:"name"`
+	Latest   int                 `json:"latest"`
+	Versions []SecretVersionInfo `json:"versions"`
+}
+
+type SecretVersionInfo struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type storedSecret struct {
+	Name     string          `json:"name"`
+	Versions []secretVersion `json:"versions"`
+}
+
+type secretVersion struct {
+	Version    int       `json:"version"`
+	Nonce      []byte    `json:"nonce"`
+	Ciphertext []byte    `json:"ciphertext"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func secretPath(name string) string {
+	return filepath.Join("secrets", name+".json")
+}
+
+func (s *storedSecret) info() SecretInfo {
+	info := SecretInfo{Name: s.Name, Versions: []SecretVersionInfo{}}
+	for _, version := range s.Versions {
+		info.Versions = append(info.Versions, SecretVersionInfo{
+			Version:   version.Version,
+			CreatedAt: version.CreatedAt,
+		})
+		info.Latest = version.Version
+	}
+	return info
+}
+
+// secretStore keeps secrets encrypted with the operator's key. Values go in
+// through the API but only ever come out into the environment of a task.
+type secretStore struct {
+	sync.Mutex
+	aead    cipher.AEAD
+	secrets map[string]*storedSecret
+}
+
+var secrets = &secretStore{
+	secrets: map[string]*storedSecret{},
+}
+
+// configure sets the key from a 32 byte AES-256 key, hex or base64 encoded.
+func (s *secretStore) configure(encoded string) error {
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil || len(key) != 32 {
+		return errors.New("SECRETS_KEY must be 32 bytes, hex or base64 encoded")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	s.aead, err = cipher.NewGCM(block)
+	return err
+}
+
+func (s *secretStore) load() error {
+	s.Lock()
+	defer s.Unlock()
+
+	return loadJSONDir("secrets", func(path string) error {
+		secret := &storedSecret{}
+		if err := loadJSON(path, secret); err != nil {
+			return err
+		}
+		s.secrets[secret.Name] = secret
+		return nil
+	})
+}
+
+// additionalData binds a ciphertext to its secret and version, so that one
+// cannot be passed off as another.
+func additionalData(name string, version int) []byte {
+	return []byte(name + "/" + strconv.Itoa(version))
+}
+
+func (s *secretStore) put(name, value string) (SecretVersionInfo, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.aead == nil {
+		return SecretVersionInfo{}, errSecretsDisabled
+	}
+
+	secret, ok := s.secrets[name]
+	if !ok {
+		secret = &storedSecret{Name: name}
+	}
+
+	version := secretVersion{
+		Version:   1,
+		Nonce:     make([]byte, s.aead.NonceSize()),
+		CreatedAt: time.Now(),
+	}
+	if len(secret.Versions) > 0 {
+		version.Version = secret.Versions[len(secret.Versions)-1].Version + 1
+	}
+	if _, err := io.ReadFull(rand.Reader, version.Nonce); err != nil {
+		return SecretVersionInfo{}, err
+	}
+	version.Ciphertext = s.aead.Seal(nil, version.Nonce, []byte(value), additionalData(name, version.Version))
+
+	updated := &storedSecret{
+		Name:     name,
+		Versions: append(append([]secretVersion{}, secret.Versions...), version),
+	}
+	if err := saveJSON(secretPath(name), updated); err != nil {
+		return SecretVersionInfo{}, err
+	}
+	s.secrets[name] = updated
+
+	return SecretVersionInfo{Version: version.Version, CreatedAt: version.CreatedAt}, nil
+}
+
+func (s *secretStore) exists(ref SecretRef) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	secret, ok := s.secrets[ref.Secret]
+	if !ok {
+		return false
+	}
+	if ref.Version == 0 {
+		return true
+	}
+	for _, version := range secret.Versions {
+		if version.Version == ref.Version {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *secretStore) value(ref SecretRef) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.aead == nil {
+		return "", errSecretsDisabled
+	}
+
+	secret, ok := s.secrets[ref.Secret]
+	if !ok || len(secret.Versions) == 0 {
+		return "", fmt.Errorf("could not find secret: %s", ref.Secret)
+	}
+
+	version := secret.Versions[len(secret.Versions)-1]
+	if ref.Version != 0 {
+		found := false
+		for _, v := range secret.Versions {
+			if v.Version == ref.Version {
+				version, found = v, true
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("could not find version %d of secret: %s", ref.Version, ref.Secret)
+		}
+	}
+
+	plaintext, err := s.aead.Open(nil, version.Nonce, version.Ciphertext, additionalData(ref.Secret, version.Version))
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt secret: %s", ref.Secret)
+	}
+	return string(plaintext), nil
+}
+
+// env resolves the secrets a function asks for into environment variables.
+func (s *secretStore) env(refs []SecretRef) ([]models.EnvironmentVariable, error) {
+	env := []models.EnvironmentVariable{}
+	for _, ref := range refs {
+		value, err := s.value(ref)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, models.EnvironmentVariable{Name: ref.Env, Value: value})
+	}
+	return env, nil
+}
+
+func (s *secretStore) info(name string) (SecretInfo, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	secret, ok := s.secrets[name]
+	if !ok {
+		return SecretInfo{}, false
+	}
+	return secret.info(), true
+}
+
+func (s *secretStore) list() []SecretInfo {
+	s.Lock()
+	defer s.Unlock()
+
+	list := []SecretInfo{}
+	for _, secret := range s.secrets {
+		list = append(list, secret.info())
+	}
+	sort.Sort(secretsByName(list))
+
+	return list
+}
+
+func (s *secretStore) remove(name string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.secrets[name]; !ok {
+		return false
+	}
+	delete(s.secrets, name)
+	if err := os.Remove(secretPath(name)); err != nil {
+		log.Println("failed to remove secret:", err)
+	}
+
+	return true
+}
+
+type secretsByName []SecretInfo
+
+func (s secretsByName) Len() int           { return len(s) }
+func (s secretsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s secretsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func putSecretHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	var body struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	version, err := secrets.put(name, body.Value)
+	if err == errSecretsDisabled {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "could not save secret", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, version)
+}
+
+func getSecretHandler(w http.ResponseWriter, r *http.Request) {
+	info, ok := secrets.info(r.URL.Query().Get(":name"))
+	if !ok {
+		http.Error(w, "could not find secret", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, info)
+}
+
+func listSecretsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, secrets.list())
+}
+
+func deleteSecretHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	if !secrets.remove(name) {
+		http.Error(w, "could not find secret", http.StatusNotFound)
+		return
+	}
+
+	io.WriteString(w, "deleted secret: "+name)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// semver is a major.minor.patch version. Prerelease and build metadata are
+// ignored.
+type semver [3]int
+
+func (v semver) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+func (v semver) compare(o semver) int {
+	for i := range v {
+		if v[i] != o[i] {
+			if v[i] < o[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// parsePartial parses a possibly partial version such as 1, 1.2, 1.2.x or *,
+// and reports how many of its parts were given.
+func parsePartial(s string) (semver, int, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "="), "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+
+	var v semver
+	if s == "" {
+		return v, 0, nil
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, 0, fmt.Errorf("invalid version: %s", s)
+	}
+	for i, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			return v, i, nil
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, 0, fmt.Errorf("invalid version: %s", s)
+		}
+		v[i] = n
+	}
+	return v, len(parts), nil
+}
+
+func parseSemver(s string) (semver, error) {
+	v, parts, err := parsePartial(s)
+	if err == nil && parts != 3 {
+		err = fmt.Errorf("invalid version: %s", s)
+	}
+	return v, err
+}
+
+// bump returns the first version after every version matching the first
+// parts of v.
+func (v semver) bump(parts int) semver {
+	switch parts {
+	case 1:
+		return semver{v[0] + 1, 0, 0}
+	case 2:
+		return semver{v[0], v[1] + 1, 0}
+	}
+	return semver{v[0], v[1], v[2] + 1}
+}
+
+type comparator struct {
+	op string
+	v  semver
+}
+
+func (c comparator) matches(v semver) bool {
+	n := v.compare(c.v)
+	switch c.op {
+	case ">":
+		return n > 0
+	case ">=":
+		return n >= 0
+	case "<":
+		return n < 0
+	case "<=":
+		return n <= 0
+	}
+	return n == 0
+}
+
+// semverRange is a set of alternatives, each of which is a set of
+// comparators that must all match, as in npm's ranges.
+type semverRange [][]comparator
+
+func (r semverRange) matches(v semver) bool {
+	for _, set := range r {
+		ok := true
+		for _, c := range set {
+			if !c.matches(v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSemverRange parses the range syntax npm uses in package.json, with
+// comparators, x-ranges, tilde, caret and hyphen ranges, and ||.
+func parseSemverRange(s string) (semverRange, error) {
+	var r semverRange
+	for _, alternative := range strings.Split(s, "||") {
+		set, err := parseComparatorSet(alternative)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, set)
+	}
+	return r, nil
+}
+
+func parseComparatorSet(s string) ([]comparator, error) {
+	fields := strings.Fields(s)
+
+	// Join operators written apart from their version, as in ">= 1.2".
+	tokens := []string{}
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		if strings.Trim(field, "<>=~^") == "" && field != "-" && i+1 < len(fields) {
+			field += fields[i+1]
+			i++
+		}
+		tokens = append(tokens, field)
+	}
+
+	if len(tokens) == 3 && tokens[1] == "-" {
+		return hyphenRange(tokens[0], tokens[2])
+	}
+
+	set := []comparator{}
+	if len(tokens) == 0 {
+		return set, nil
+	}
+	for _, token := range tokens {
+		comparators, err := parseComparator(token)
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, comparators...)
+	}
+	return set, nil
+}
+
+func hyphenRange(from, to string) ([]comparator, error) {
+	low, _, err := parsePartial(from)
+	if err != nil {
+		return nil, err
+	}
+	high, parts, err := parsePartial(to)
+	if err != nil {
+		return nil, err
+	}
+
+	set := []comparator{{">=", low}}
+	switch parts {
+	case 0:
+	case 3:
+		set = append(set, comparator{"<=", high})
+	default:
+		set = append(set, comparator{"<", high.bump(parts)})
+	}
+	return set, nil
+}
+
+func parseComparator(token string) ([]comparator, error) {
+	op := ""
+	for _, candidate := range []string{">=", "<=", ">", "<", "=", "~", "^"} {
+		if strings.HasPrefix(token, candidate) {
+			op = candidate
+			break
+		}
+	}
+
+	v, parts, err := parsePartial(strings.TrimPrefix(token, op))
+	if err != nil {
+		return nil, err
+	}
+
+	if parts == 0 {
+		switch op {
+		case "<", ">":
+			// Nothing is above or below every version.
+			return []comparator{{"<", semver{}}}, nil
+		}
+		return []comparator{}, nil
+	}
+
+	switch op {
+	case ">":
+		if parts < 3 {
+			return []comparator{{">=", v.bump(parts)}}, nil
+		}
+		return []comparator{{">", v}}, nil
+	case ">=":
+		return []comparator{{">=", v}}, nil
+	case "<":
+		return []comparator{{"<", v}}, nil
+	case "<=":
+		if parts < 3 {
+			return []comparator{{"<", v.bump(parts)}}, nil
+		}
+		return []comparator{{"<=", v}}, nil
+	case "~":
+		if parts == 1 {
+			return []comparator{{">=", v}, {"<", v.bump(1)}}, nil
+		}
+		return []comparator{{">=", v}, {"<", v.bump(2)}}, nil
+	case "^":
+		switch {
+		case v[0] > 0 || parts == 1:
+			return []comparator{{">=", v}, {"<", v.bump(1)}}, nil
+		case v[1] > 0 || parts == 2:
+			return []comparator{{">=", v}, {"<", v.bump(2)}}, nil
+		}
+		return []comparator{{">=", v}, {"<", v.bump(3)}}, nil
+	}
+
+	if parts < 3 {
+		return []comparator{{">=", v}, {"<", v.bump(parts)}}, nil
+	}
+	return []comparator{{"=", v}}, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import "testing"
+
+func TestParseSemver(t *testing.T) {
+	for _, test := range []struct {
+		s string
+		v semver
+	}{
+		{"1.2.3", semver{1, 2, 3}},
+		{"v0.10.40", semver{0, 10, 40}},
+		{"=4.1.0", semver{4, 1, 0}},
+		{"1.2.3-beta.1", semver{1, 2, 3}},
+		{"1.2.3+build", semver{1, 2, 3}},
+	} {
+		v, err := parseSemver(test.s)
+		if err != nil {
+			t.Errorf("parseSemver(%q): %s", test.s, err)
+			continue
+		}
+		if v != test.v {
+			t.Errorf("parseSemver(%q) = %s, expected %s", test.s, v, test.v)
+		}
+	}
+
+	for _, s := range []string{"", "1", "1.2", "1.2.x", "1.2.3.4", "a.b.c", "1.-2.3"} {
+		if _, err := parseSemver(s); err == nil {
+			t.Errorf("parseSemver(%q): expected an error", s)
+		}
+	}
+}
+
+func TestSemverRangeMatches(t *testing.T) {
+	for _, test := range []struct {
+		r     string
+		match []string
+		miss  []string
+	}{
+		{"", []string{"0.0.0", "4.2.1"}, nil},
+		{"*", []string{"0.0.0", "4.2.1"}, nil},
+		{"1.2.3", []string{"1.2.3"}, []string{"1.2.2", "1.2.4"}},
+		{"1.2", []string{"1.2.0", "1.2.9"}, []string{"1.1.9", "1.3.0"}},
+		{"1.x", []string{"1.0.0", "1.9.9"}, []string{"0.9.9", "2.0.0"}},
+		{">1.2.3", []string{"1.2.4"}, []string{"1.2.3"}},
+		{">1.2", []string{"1.3.0"}, []string{"1.2.9"}},
+		{">= 1.2.3", []string{"1.2.3", "2.0.0"}, []string{"1.2.2"}},
+		{"<1.2.3", []string{"1.2.2"}, []string{"1.2.3"}},
+		{"<=1.2", []string{"1.2.9"}, []string{"1.3.0"}},
+		{"<*", nil, []string{"0.0.0", "1.0.0"}},
+		{"~1.2.3", []string{"1.2.3", "1.2.9"}, []string{"1.2.2", "1.3.0"}},
+		{"~1", []string{"1.0.0", "1.9.9"}, []string{"2.0.0"}},
+		{"^1.2.3", []string{"1.2.3", "1.9.0"}, []string{"1.2.2", "2.0.0"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+		{"^0.x", []string{"0.0.0", "0.9.9"}, []string{"1.0.0"}},
+		{"1.2.3 - 2.3.4", []string{"1.2.3", "2.3.4"}, []string{"1.2.2", "2.3.5"}},
+		{"1.2 - 2.3", []string{"1.2.0", "2.3.9"}, []string{"1.1.9", "2.4.0"}},
+		{">=1.0.0 <2.0.0", []string{"1.0.0", "1.9.9"}, []string{"0.9.9", "2.0.0"}},
+		{"0.10.x || >=4", []string{"0.10.40", "4.0.0", "5.1.0"}, []string{"0.12.0", "3.9.9"}},
+	} {
+		r, err := parseSemverRange(test.r)
+		if err != nil {
+			t.Errorf("parseSemverRange(%q): %s", test.r, err)
+			continue
+		}
+		for _, s := range test.match {
+			if !r.matches(mustParseSemver(t, s)) {
+				t.Errorf("%q does not match %s", test.r, s)
+			}
+		}
+		for _, s := range test.miss {
+			if r.matches(mustParseSemver(t, s)) {
+				t.Errorf("%q matches %s", test.r, s)
+			}
+		}
+	}
+
+	for _, s := range []string{"1.2.3.4", ">=a", "~1.2.z", "1.2 - b"} {
+		if _, err := parseSemverRange(s); err == nil {
+			t.Errorf("parseSemverRange(%q): expected an error", s)
+		}
+	}
+}
+
+func mustParseSemver(t *testing.T, s string) semver {
+	v, err := parseSemver(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
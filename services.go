@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry-community/go-cfenv"
+	"github.com/cloudfoundry-incubator/runtime-schema/models"
+)
+
+const (
+	serviceFormatEnv  = "env"
+	serviceFormatVCAP = "vcap"
+)
+
+// writeVCAPServices writes VCAP_SERVICES, if the function has it, to a file
+// in dir for libraries that read their services from a file, and names the
+// file in VCAP_SERVICES_FILE. It is run after any env file has been sourced,
+// so that VCAP_SERVICES is there to write. A function that cannot write to
+// dir still runs, without the file.
+func writeVCAPServices(dir string) string {
+	file := dir + "/" + envFileDir + "/vcap_services.json"
+	write := fmt.Sprintf(`(umask 077 && mkdir -p %s && printf '%%s' "$VCAP_SERVICES" > %s)`, path.Dir(file), file)
+	return `if [ -n "$VCAP_SERVICES" ] && ` + write + `; then export VCAP_SERVICES_FILE=` + file + `; fi`
+}
+
+// ServiceBinding asks for the credentials of a service instance bound to the
+// gamma app. In the env format each credential becomes <Env>_<KEY>, with Env
+// defaulting to the service name.
+type ServiceBinding struct {
+	Service string `json:"service"`
+	Env     string `json:"env,omitempty"`
+}
+
+var nonIdentifier = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// serviceVCAP is a service as Cloud Foundry puts it in VCAP_SERVICES.
+type serviceVCAP struct {
+	Name        string            `json:"name"`
+	Label       string            `json:"label"`
+	Tags        []string          `json:"tags"`
+	Plan        string            `json:"plan"`
+	Credentials map[string]string `json:"credentials"`
+}
+
+func validServiceFormat(format string) error {
+	switch format {
+	case "", serviceFormatEnv, serviceFormatVCAP:
+		return nil
+	}
+	return fmt.Errorf("unknown service format: %s", format)
+}
+
+func envIdentifier(name string) string {
+	return strings.ToUpper(nonIdentifier.ReplaceAllString(name, "_"))
+}
+
+func (binding ServiceBinding) prefix() string {
+	if binding.Env != "" {
+		return binding.Env
+	}
+	return envIdentifier(binding.Service)
+}
+
+func boundService(name string) (*cfenv.Service, error) {
+	currentEnv, err := cfenv.Current()
+	if err != nil {
+		return nil, fmt.Errorf("could not find bound service %s: not running on Cloud Foundry", name)
+	}
+	service, err := currentEnv.Services.WithName(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not find bound service: %s", name)
+	}
+	return service, nil
+}
+
+// serviceEnv reads the credentials of the bound services a function asks
+// for, either as one variable per credential or as VCAP_SERVICES, which is
+// also written to a file; see writeVCAPServices.
+func serviceEnv(bindings []ServiceBinding, format string) ([]models.EnvironmentVariable, error) {
+	env := []models.EnvironmentVariable{}
+	vcap := map[string][]serviceVCAP{}
+
+	for _, binding := range bindings {
+		service, err := boundService(binding.Service)
+		if err != nil {
+			return nil, err
+		}
+
+		if format == serviceFormatVCAP {
+			vcap[service.Label] = append(vcap[service.Label], serviceVCAP{
+				Name:        service.Name,
+				Label:       service.Label,
+				Tags:        service.Tags,
+				Plan:        service.Plan,
+				Credentials: service.Credentials,
+			})
+			continue
+		}
+
+		keys := []string{}
+		for key := range service.Credentials {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			env = append(env, models.EnvironmentVariable{
+				Name:  binding.prefix() + "_" + envIdentifier(key),
+				Value: service.Credentials[key],
+			})
+		}
+	}
+
+	if format == serviceFormatVCAP && len(bindings) > 0 {
+		data, err := json.Marshal(vcap)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, models.EnvironmentVariable{Name: "VCAP_SERVICES", Value: string(data)})
+	}
+
+	return env, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor"
+)
+
+// defaultStack is the stack functions run on unless they set their own. It
+// can be set for the deployment with STACK.
+var defaultStack = "lucid64"
+
+const cellCacheTTL = 10 * time.Second
+
+type unavailableStackError string
+
+func (stack unavailableStackError) Error() string {
+	return fmt.Sprintf("no cell has stack %s, so the function could never be placed", string(stack))
+}
+
+func stackFor(function string) string {
+	return stackOf(configs.get(function))
+}
+
+func stackOf(config FunctionConfig) string {
+	if config.Stack != "" {
+		return config.Stack
+	}
+	return defaultStack
+}
+
+// cellInventory caches the receptor's cells for a short while, so that
+// checking a stack on every call does not mean a request to Diego each time.
+type cellInventory struct {
+	sync.Mutex
+	cells     []receptor.CellResponse
+	fetchedAt time.Time
+}
+
+var cells = &cellInventory{}
+
+func (c *cellInventory) list() ([]receptor.CellResponse, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.cells != nil && time.Since(c.fetchedAt) < cellCacheTTL {
+		return c.cells, nil
+	}
+
+	list, err := client.Cells()
+	if err != nil {
+		return nil, err
+	}
+	c.cells = list
+	c.fetchedAt = time.Now()
+
+	return c.cells, nil
+}
+
+// checkStack fails if no cell advertises stack, as tasks and LRPs for it
+// would otherwise wait to be placed forever.
+func (c *cellInventory) checkStack(stack string) error {
+	list, err := c.list()
+	if err != nil {
+		return fmt.Errorf("could not look up cells: %s", err)
+	}
+	for _, cell := range list {
+		if cell.Stack == stack {
+			return nil
+		}
+	}
+	return unavailableStackError(stack)
+}
+
+// stackErrorStatus tells a missing stack, which is the client's to fix, from
+// failing to ask Diego about it.
+func stackErrorStatus(err error) int {
+	if _, ok := err.(unavailableStackError); ok {
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
+
+type CellInventory struct {
+	Cells  []receptor.CellResponse `json:"cells"`
+	Stacks map[string]int          `json:"stacks"`
+}
+
+func cellsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "only admins can list cells", http.StatusForbidden)
+		return
+	}
+
+	list, err := client.Cells()
+	if err != nil {
+		log.Println("failed to list cells:", err)
+		http.Error(w, "could not list cells", http.StatusBadGateway)
+		return
+	}
+	sort.Sort(byCellID(list))
+
+	inventory := CellInventory{Cells: list, Stacks: map[string]int{}}
+	for _, cell := range list {
+		inventory.Stacks[cell.Stack]++
+	}
+
+	writeJSON(w, inventory)
+}
+
+type byCellID []receptor.CellResponse
+
+func (c byCellID) Len() int           { return len(c) }
+func (c byCellID) Less(i, j int) bool { return c[i].CellID < c[j].CellID }
+func (c byCellID) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/cloudfoundry-incubator/runtime-schema/models"
+)
+
+const maxHookBody = 1 << 20
+
+// Trigger turns arbitrary webhook requests into calls of Function. Env and
+// Payload are text/template templates rendered against the incoming request.
+type Trigger struct {
+	Name      string            `json:"name"`
+	Function  string            `json:"function"`
+	Env       map[string]string `json:"env,omitempty"`
+	Payload   string            `json:"payload,omitempty"`
+	Signature *SignatureCheck   `json:"signature,omitempty"`
+}
+
+// SignatureCheck verifies an HMAC of the request body, sent hex encoded in
+// Header with an optional Prefix, e.g. GitHub's "X-Hub-Signature-256" with
+// "sha256=". The key is the secret named by SecretRef. A Secret given when
+// the trigger is registered is moved into the secret store, so that only the
+// reference is kept with the trigger.
+type SignatureCheck struct {
+	Header        string `json:"header"`
+	Algorithm     string `json:"algorithm"`
+	Prefix        string `json:"prefix,omitempty"`
+	Secret        string `json:"secret,omitempty"`
+	SecretRef     string `json:"secret_ref,omitempty"`
+	SecretVersion int    `json:"secret_version,omitempty"`
+}
+
+type hookRequest struct {
+	Headers map[string]string
+	Query   map[string]string
+	Body    interface{}
+	RawBody string
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+func triggerPath(name string) string {
+	return filepath.Join("triggers", name+".json")
+}
+
+func (t Trigger) validate() error {
+	if t.Function == "" {
+		return errors.New("trigger has no function")
+	}
+
+	for name, text := range t.Env {
+		if err := validEnv([]models.EnvironmentVariable{{Name: name}}); err != nil {
+			return err
+		}
+		if _, err := template.New(name).Funcs(templateFuncs).Parse(text); err != nil {
+			return err
+		}
+	}
+	if _, err := template.New("payload").Funcs(templateFuncs).Parse(t.Payload); err != nil {
+		return err
+	}
+
+	if t.Signature != nil {
+		if t.Signature.Header == "" || t.Signature.Secret == "" && t.Signature.SecretRef == "" {
+			return errors.New("signature needs a header and a secret")
+		}
+		if t.Signature.Secret != "" && t.Signature.SecretRef != "" {
+			return errors.New("signature needs only one of secret and secret_ref")
+		}
+		if _, err := t.Signature.hash(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s SignatureCheck) hash() (func() hash.Hash, error) {
+	switch s.Algorithm {
+	case "sha1":
+		return sha1.New, nil
+	case "sha256", "":
+		return sha256.New, nil
+	}
+	return nil, fmt.Errorf("unknown signature algorithm: %s", s.Algorithm)
+}
+
+// triggerSecretName is the stored secret that holds a trigger's signature
+// key when it was registered with the key itself.
+func triggerSecretName(trigger string) string {
+	return "trigger-" + trigger
+}
+
+// storeSecret moves a signature key given in full into the secret store.
+func (s *SignatureCheck) storeSecret(trigger string) error {
+	if s.Secret == "" {
+		return nil
+	}
+	if _, err := secrets.put(triggerSecretName(trigger), s.Secret); err != nil {
+		return err
+	}
+	s.SecretRef = triggerSecretName(trigger)
+	s.SecretVersion = 0
+	s.Secret = ""
+	return nil
+}
+
+func (s SignatureCheck) key() (string, error) {
+	if s.SecretRef == "" {
+		// Registered before keys were kept in the secret store, and not
+		// yet moved there.
+		return s.Secret, nil
+	}
+	return secrets.value(SecretRef{Secret: s.SecretRef, Version: s.SecretVersion})
+}
+
+func (s SignatureCheck) verify(r *http.Request, body []byte, key string) bool {
+	newHash, err := s.hash()
+	if err != nil {
+		return false
+	}
+
+	header := r.Header.Get(s.Header)
+	if !strings.HasPrefix(header, s.Prefix) {
+		return false
+	}
+	signature, err := hex.DecodeString(strings.TrimPrefix(header, s.Prefix))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(newHash, []byte(key))
+	mac.Write(body)
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+func render(name, text string, data hookRequest) (string, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// call maps a webhook request onto a function call. Without a payload
+// template, a JSON body is passed through as the payload.
+func (t Trigger) call(r *http.Request, body []byte) (FunctionCall, error) {
+	data := hookRequest{
+		Headers: map[string]string{},
+		Query:   map[string]string{},
+		RawBody: string(body),
+	}
+	for name := range r.Header {
+		data.Headers[name] = r.Header.Get(name)
+	}
+	for name := range r.URL.Query() {
+		if !strings.HasPrefix(name, ":") {
+			data.Query[name] = r.URL.Query().Get(name)
+		}
+	}
+	json.Unmarshal(body, &data.Body)
+
+	call := FunctionCall{Caller: "trigger:" + t.Name}
+
+	names := []string{}
+	for name := range t.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, err := render(name, t.Env[name], data)
+		if err != nil {
+			return FunctionCall{}, err
+		}
+		call.Env = append(call.Env, models.EnvironmentVariable{Name: name, Value: value})
+	}
+	if err := validEnv(call.Env); err != nil {
+		return FunctionCall{}, err
+	}
+
+	if t.Payload != "" {
+		payload, err := render("payload", t.Payload, data)
+		if err != nil {
+			return FunctionCall{}, err
+		}
+		if !json.Valid([]byte(payload)) {
+			return FunctionCall{}, errors.New("payload template did not produce valid JSON")
+		}
+		call.Payload = json.RawMessage(payload)
+	} else if data.Body != nil {
+		call.Payload = json.RawMessage(body)
+	}
+
+	return call, nil
+}
+
+func putTriggerHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	var trigger Trigger
+	if err := json.NewDecoder(r.Body).Decode(&trigger); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	trigger.Name = name
+
+	if err := trigger.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := statFunction(trigger.Function); err != nil {
+		http.Error(w, "could not find function", http.StatusNotFound)
+		return
+	}
+
+	if trigger.Signature != nil {
+		ref := SecretRef{Secret: trigger.Signature.SecretRef, Version: trigger.Signature.SecretVersion}
+		if ref.Secret != "" && !secrets.exists(ref) {
+			http.Error(w, "could not find secret: "+ref.Secret, http.StatusBadRequest)
+			return
+		}
+		err := trigger.Signature.storeSecret(name)
+		if err == errSecretsDisabled {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "could not save trigger secret", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := saveJSON(triggerPath(name), trigger); err != nil {
+		log.Println(err)
+		http.Error(w, "could not save trigger", http.StatusInternalServerError)
+		return
+	}
+
+	io.WriteString(w, "registered trigger: "+name)
+}
+
+func getTriggerHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	var trigger Trigger
+	if err := loadJSON(triggerPath(name), &trigger); err != nil {
+		http.Error(w, "could not find trigger", http.StatusNotFound)
+		return
+	}
+
+	if trigger.Signature != nil {
+		trigger.Signature.Secret = ""
+	}
+
+	writeJSON(w, trigger)
+}
+
+func deleteTriggerHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	var trigger Trigger
+	loadJSON(triggerPath(name), &trigger)
+
+	if err := os.Remove(triggerPath(name)); err != nil {
+		http.Error(w, "could not find trigger", http.StatusNotFound)
+		return
+	}
+	if trigger.Signature != nil && trigger.Signature.SecretRef == triggerSecretName(name) {
+		secrets.remove(triggerSecretName(name))
+	}
+
+	io.WriteString(w, "deleted trigger: "+name)
+}
+
+// migrateTriggerSecrets moves the signature keys of triggers registered
+// before keys were kept in the secret store into it.
+func migrateTriggerSecrets() error {
+	return loadJSONDir("triggers", func(path string) error {
+		var trigger Trigger
+		if err := loadJSON(path, &trigger); err != nil {
+			return err
+		}
+		if trigger.Signature == nil || trigger.Signature.Secret == "" {
+			return nil
+		}
+		if err := trigger.Signature.storeSecret(trigger.Name); err != nil {
+			return err
+		}
+		return saveJSON(path, trigger)
+	})
+}
+
+func hookHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":trigger")
+
+	var trigger Trigger
+	if err := loadJSON(triggerPath(name), &trigger); err != nil {
+		http.Error(w, "could not find trigger", http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxHookBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if trigger.Signature != nil {
+		key, err := trigger.Signature.key()
+		if err != nil {
+			log.Println("failed to read trigger secret:", name, err)
+			http.Error(w, "could not read trigger secret", http.StatusInternalServerError)
+			return
+		}
+		if !trigger.Signature.verify(r, body, key) {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if err := statFunction(trigger.Function); err != nil {
+		http.Error(w, "could not find function", http.StatusNotFound)
+		return
+	}
+
+	call, err := trigger.call(r, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := callFunction(trigger.Function, call)
+	if err != nil {
+		http.Error(w, err.Error(), callErrorStatus(err))
+		return
+	}
+
+	writeJSON(w, response)
+}
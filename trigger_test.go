@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSignatureCheckVerify(t *testing.T) {
+	body := []byte(`{"ref": "refs/heads/master"}`)
+
+	// Signatures of body with the key "secret".
+	const (
+		sha256Signature = "a8b64b2452d60d8eb1f242946ce9a8c1a5ea84eef76dae2c6da31adbde46c11e"
+		sha1Signature   = "25f1bd59437ba8413a895deeee0c82c6cb99f741"
+	)
+
+	for _, test := range []struct {
+		name   string
+		check  SignatureCheck
+		header string
+		key    string
+		valid  bool
+	}{
+		{
+			name:   "accepts a sha256 signature",
+			check:  SignatureCheck{Header: "X-Hub-Signature-256", Algorithm: "sha256", Prefix: "sha256="},
+			header: "sha256=" + sha256Signature,
+			key:    "secret",
+			valid:  true,
+		},
+		{
+			name:   "defaults to sha256",
+			check:  SignatureCheck{Header: "X-Hub-Signature-256", Prefix: "sha256="},
+			header: "sha256=" + sha256Signature,
+			key:    "secret",
+			valid:  true,
+		},
+		{
+			name:   "accepts a sha1 signature",
+			check:  SignatureCheck{Header: "X-Hub-Signature", Algorithm: "sha1", Prefix: "sha1="},
+			header: "sha1=" + sha1Signature,
+			key:    "secret",
+			valid:  true,
+		},
+		{
+			name:   "rejects a signature made with another key",
+			check:  SignatureCheck{Header: "X-Hub-Signature-256", Algorithm: "sha256", Prefix: "sha256="},
+			header: "sha256=" + sha256Signature,
+			key:    "other",
+		},
+		{
+			name:   "rejects a signature without its prefix",
+			check:  SignatureCheck{Header: "X-Hub-Signature-256", Algorithm: "sha256", Prefix: "sha256="},
+			header: sha256Signature,
+			key:    "secret",
+		},
+		{
+			name:   "rejects a signature that is not hex",
+			check:  SignatureCheck{Header: "X-Hub-Signature-256", Algorithm: "sha256", Prefix: "sha256="},
+			header: "sha256=not-hex",
+			key:    "secret",
+		},
+		{
+			name:  "rejects a missing signature",
+			check: SignatureCheck{Header: "X-Hub-Signature-256", Algorithm: "sha256", Prefix: "sha256="},
+			key:   "secret",
+		},
+		{
+			name:   "rejects an unknown algorithm",
+			check:  SignatureCheck{Header: "X-Hub-Signature-256", Algorithm: "md5", Prefix: "sha256="},
+			header: "sha256=" + sha256Signature,
+			key:    "secret",
+		},
+	} {
+		r, _ := http.NewRequest("POST", "/hook/deploy", nil)
+		if test.header != "" {
+			r.Header.Set(test.check.Header, test.header)
+		}
+
+		if valid := test.check.verify(r, body, test.key); valid != test.valid {
+			t.Errorf("%s: verify = %t, expected %t", test.name, valid, test.valid)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/cloudfoundry-community/go-cfenv"
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/runtime-schema/models"
+)
+
+const (
+	functionTypeTask = "task"
+	functionTypeHTTP = "http"
+)
+
+const webPort = 8080
+
+var errHTTPFunction = errors.New("http functions are served on their routes, not called")
+
+// routeDomain is the domain that http functions are routed under, as
+// <name>.<routeDomain>.
+var routeDomain = os.Getenv("ROUTE_DOMAIN")
+
+var errNoRouteDomain = errors.New("ROUTE_DOMAIN not set")
+
+type HTTPConfig struct {
+	Instances int      `json:"instances"`
+	Routes    []string `json:"routes,omitempty"`
+}
+
+func validFunctionType(functionType string) error {
+	switch functionType {
+	case "", functionTypeTask, functionTypeHTTP:
+		return nil
+	}
+	return fmt.Errorf("unknown function type: %s", functionType)
+}
+
+func defaultRouteDomain() string {
+	currentEnv, err := cfenv.Current()
+	if err != nil || len(currentEnv.ApplicationUri) == 0 {
+		return ""
+	}
+	uri := currentEnv.ApplicationUri[0]
+	if i := strings.Index(uri, "."); i >= 0 {
+		return uri[i+1:]
+	}
+	return ""
+}
+
+func httpConfig(config *HTTPConfig) HTTPConfig {
+	if config == nil {
+		return HTTPConfig{Instances: 1}
+	}
+	return *config
+}
+
+// functionRoutes is the function's own route followed by any extra routes in
+// its configuration.
+func functionRoutes(name string, config HTTPConfig) ([]string, error) {
+	if routeDomain == "" {
+		return nil, errNoRouteDomain
+	}
+	return append([]string{name + "." + routeDomain}, config.Routes...), nil
+}
+
+// routeError is a route that an http function cannot be given.
+type routeError string
+
+func (e routeError) Error() string {
+	return string(e)
+}
+
+func routeErrorStatus(err error) int {
+	if _, ok := err.(routeError); ok {
+		return http.StatusBadRequest
+	}
+	if err == errNoRouteDomain {
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadGateway
+}
+
+// checkRoutes makes sure that an http function's routes are each a single
+// name under routeDomain, and that nothing else has them: not gamma itself,
+// not another function, whose own route it may be, and not any other process
+// on Diego.
+func checkRoutes(name string, config FunctionConfig) error {
+	if config.Type != functionTypeHTTP {
+		return nil
+	}
+	routes, err := functionRoutes(name, httpConfig(config.HTTP))
+	if err != nil {
+		return err
+	}
+
+	self := strings.TrimPrefix(address(), "http://")
+	for i, route := range routes {
+		if route == self {
+			return routeError("route is gamma's own: " + route)
+		}
+		if i == 0 {
+			continue
+		}
+		host := strings.TrimSuffix(route, "."+routeDomain)
+		if host == route || host == "" || strings.Contains(host, ".") {
+			return routeError(fmt.Sprintf("routes must be <name>.%s: %s", routeDomain, route))
+		}
+		if host != name && statFunction(host) == nil {
+			return routeError(fmt.Sprintf("route belongs to function %s: %s", host, route))
+		}
+	}
+
+	desired, err := client.DesiredLRPs()
+	if err != nil {
+		return err
+	}
+	for _, lrp := range desired {
+		if lrp.ProcessGuid == processGuid(name) {
+			continue
+		}
+		for _, taken := range lrp.Routes {
+			for _, route := range routes {
+				if route == taken {
+					return routeError("route already in use: " + route)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func webLRP(name string, config HTTPConfig) (receptor.DesiredLRPCreateRequest, error) {
+	routes, err := functionRoutes(name, config)
+	if err != nil {
+		return receptor.DesiredLRPCreateRequest{}, err
+	}
+
+	// An http function has no call to carry its env, so the function's own
+	// env, secrets and service credentials are set on its process.
+	function := configs.get(name)
+	secretEnv, err := protectedEnv(function.Secrets, function.Services, function.ServiceFormat)
+	if err != nil {
+		return receptor.DesiredLRPCreateRequest{}, err
+	}
+	env := mergeEnv(function.Env, secretEnv, homeEnv())
+
+	runtime := runtimeFor(name)
+	portEnv := []models.EnvironmentVariable{{Name: "PORT", Value: fmt.Sprint(webPort)}}
+
+	return receptor.DesiredLRPCreateRequest{
+		ProcessGuid:          processGuid(name),
+		Domain:               "gamma",
+		RootFSPath:           runtime.RootFS,
+		Instances:            config.Instances,
+		Stack:                runtime.Stack,
+		EnvironmentVariables: defaultEnv,
+		Setup:                installAction(name),
+		Action: &models.RunAction{
+			Path:           "/bin/sh",
+			Args:           []string{"-c", runtime.runCommand("/home/vcap", defaultEntrypoint, false)},
+			Env:            append(portEnv, env...),
+			ResourceLimits: resourceLimits(name),
+			Privileged:     privileged(name),
+		},
+		Monitor: &models.RunAction{
+			Path: "/bin/sh",
+			Args: []string{"-c", runtime.PortCheck},
+			Env:  portEnv,
+		},
+		Ports:     []uint32{webPort},
+		Routes:    routes,
+		LogGuid:   "gamma",
+		LogSource: "gamma:" + name,
+	}, nil
+}
+
+func removeLRP(name string) error {
+	err := client.DeleteDesiredLRP(processGuid(name))
+	if rerr, ok := err.(receptor.Error); ok && rerr.Type == receptor.DesiredLRPNotFound {
+		return nil
+	}
+	return err
+}
+
+// deployFunction brings the function's long-running processes, if it has
+// any, in line with config. With replace set, or when the function changes
+// type, they are recreated so that they run the current tarball.
+func deployFunction(name string, old, config FunctionConfig, replace bool) error {
+	if config.Type == functionTypeHTTP {
+		web := httpConfig(config.HTTP)
+		if replace || old.Type != functionTypeHTTP {
+			request, err := webLRP(name, web)
+			if err != nil {
+				return err
+			}
+			if err := removeLRP(name); err != nil {
+				return err
+			}
+			return client.CreateDesiredLRP(request)
+		}
+
+		routes, err := functionRoutes(name, web)
+		if err != nil {
+			return err
+		}
+		return client.UpdateDesiredLRP(processGuid(name), receptor.DesiredLRPUpdateRequest{
+			Instances: &web.Instances,
+			Routes:    routes,
+		})
+	}
+
+	if old.Type == functionTypeHTTP {
+		if err := removeLRP(name); err != nil {
+			return err
+		}
+	}
+	if replace {
+		return pools.restart(name, config.WarmPool)
+	}
+	return pools.sync(name, config.WarmPool)
+}
+
+type HTTPFunctionStatus struct {
+	Routes    []string         `json:"routes"`
+	Instances int              `json:"instances"`
+	Running   int              `json:"running"`
+	Healthy   bool             `json:"healthy"`
+	Actuals   []InstanceStatus `json:"actuals"`
+}
+
+type InstanceStatus struct {
+	Index int    `json:"index"`
+	State string `json:"state"`
+	Host  string `json:"host,omitempty"`
+	Port  uint32 `json:"port,omitempty"`
+	Since int64  `json:"since"`
+}
+
+func functionStatusHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	if configs.get(name).Type != functionTypeHTTP {
+		http.Error(w, "not an http function", http.StatusNotFound)
+		return
+	}
+
+	desired, err := client.GetDesiredLRP(processGuid(name))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "could not find function's processes", http.StatusBadGateway)
+		return
+	}
+
+	actuals, err := client.ActualLRPsByProcessGuid(processGuid(name))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "could not look up function's instances", http.StatusBadGateway)
+		return
+	}
+
+	status := HTTPFunctionStatus{
+		Routes:    desired.Routes,
+		Instances: desired.Instances,
+		Actuals:   []InstanceStatus{},
+	}
+	for _, actual := range actuals {
+		instance := InstanceStatus{
+			Index: actual.Index,
+			State: actual.State,
+			Host:  actual.Host,
+			Since: actual.Since,
+		}
+		for _, port := range actual.Ports {
+			if port.ContainerPort == webPort {
+				instance.Port = port.HostPort
+			}
+		}
+		if actual.State == receptor.ActualLRPStateRunning {
+			status.Running++
+		}
+		status.Actuals = append(status.Actuals, instance)
+	}
+	status.Healthy = status.Running == status.Instances
+
+	writeJSON(w, status)
+}
@@ -0,0 +1,731 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/runtime-schema/models"
+)
+
+const (
+	runStateRunning   = "running"
+	runStateSucceeded = "succeeded"
+	runStateFailed    = "failed"
+
+	stepStatePending   = "pending"
+	stepStateRunning   = "running"
+	stepStateSucceeded = "succeeded"
+	stepStateFailed    = "failed"
+	stepStateSkipped   = "skipped"
+	stepStateCancelled = "cancelled"
+)
+
+var stepNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+type Workflow struct {
+	Name  string         `json:"name"`
+	Steps []WorkflowStep `json:"steps"`
+}
+
+type WorkflowStep struct {
+	Name      string                       `json:"name"`
+	Function  string                       `json:"function"`
+	Entry     string                       `json:"entry,omitempty"`
+	Env       []models.EnvironmentVariable `json:"env,omitempty"`
+	DependsOn []string                     `json:"depends_on,omitempty"`
+	When      *StepCondition               `json:"when,omitempty"`
+}
+
+// StepCondition gates a step on a value in the JSON result of one of its
+// dependencies. Path is a dot separated list of object keys or array
+// indices. Without Equals, the value only has to be present and truthy.
+type StepCondition struct {
+	Step   string          `json:"step"`
+	Path   string          `json:"path"`
+	Equals json.RawMessage `json:"equals,omitempty"`
+}
+
+type WorkflowCall struct {
+	Env []models.EnvironmentVariable `json:"env"`
+}
+
+type WorkflowRun struct {
+	Guid      string                       `json:"guid"`
+	Workflow  Workflow                     `json:"workflow"`
+	Env       []models.EnvironmentVariable `json:"env,omitempty"`
+	State     string                       `json:"state"`
+	Steps     map[string]*StepRun          `json:"steps"`
+	CreatedAt time.Time                    `json:"created_at"`
+	UpdatedAt time.Time                    `json:"updated_at"`
+}
+
+type StepRun struct {
+	State         string          `json:"state"`
+	TaskGuid      string          `json:"task_guid,omitempty"`
+	Result        json.RawMessage `json:"result,omitempty"`
+	FailureReason string          `json:"failure_reason,omitempty"`
+}
+
+func workflowPath(name string) string {
+	return filepath.Join("workflows", name+".json")
+}
+
+func runPath(guid string) string {
+	return filepath.Join("runs", guid+".json")
+}
+
+func (wf Workflow) validate() error {
+	if len(wf.Steps) == 0 {
+		return errors.New("workflow has no steps")
+	}
+
+	deps := map[string][]string{}
+	for _, step := range wf.Steps {
+		if !stepNamePattern.MatchString(step.Name) {
+			return fmt.Errorf("invalid step name: %q", step.Name)
+		}
+		if _, exists := deps[step.Name]; exists {
+			return fmt.Errorf("duplicate step: %s", step.Name)
+		}
+		if step.Function == "" {
+			return fmt.Errorf("step %s has no function", step.Name)
+		}
+		if err := validEnv(step.Env); err != nil {
+			return fmt.Errorf("step %s: %s", step.Name, err)
+		}
+		if err := validEntrypoint(step.Function, step.Entry); err != nil {
+			return fmt.Errorf("step %s: %s: %s", step.Name, err, entrypoint(step.Entry))
+		}
+		deps[step.Name] = step.DependsOn
+	}
+
+	for _, step := range wf.Steps {
+		for _, dep := range step.DependsOn {
+			if _, exists := deps[dep]; !exists {
+				return fmt.Errorf("step %s depends on unknown step %s", step.Name, dep)
+			}
+		}
+		if step.When != nil && !contains(step.DependsOn, step.When.Step) {
+			return fmt.Errorf("step %s has a condition on %s, which it does not depend on", step.Name, step.When.Step)
+		}
+	}
+
+	visiting := map[string]bool{}
+	visited := map[string]bool{}
+	var visit func(name string) error
+	visit = func(name string) error {
+		if visiting[name] {
+			return fmt.Errorf("workflow has a cycle through %s", name)
+		}
+		if visited[name] {
+			return nil
+		}
+		visiting[name] = true
+		for _, dep := range deps[name] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		visiting[name] = false
+		visited[name] = true
+		return nil
+	}
+	for name := range deps {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cond StepCondition) holds(result json.RawMessage) bool {
+	var value interface{}
+	if len(result) == 0 || json.Unmarshal(result, &value) != nil {
+		return false
+	}
+
+	if cond.Path != "" {
+		for _, key := range strings.Split(cond.Path, ".") {
+			switch v := value.(type) {
+			case map[string]interface{}:
+				value = v[key]
+			case []interface{}:
+				index, err := strconv.Atoi(key)
+				if err != nil || index < 0 || index >= len(v) {
+					return false
+				}
+				value = v[index]
+			default:
+				return false
+			}
+		}
+	}
+
+	if len(cond.Equals) == 0 {
+		return value != nil && value != false
+	}
+
+	var expected interface{}
+	if err := json.Unmarshal(cond.Equals, &expected); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(value, expected)
+}
+
+type workflowEngine struct {
+	sync.Mutex
+	runs  map[string]*WorkflowRun
+	tasks map[string]string
+}
+
+var workflows = &workflowEngine{
+	runs:  map[string]*WorkflowRun{},
+	tasks: map[string]string{},
+}
+
+func (e *workflowEngine) load() error {
+	e.Lock()
+	defer e.Unlock()
+
+	err := loadJSONDir("runs", func(path string) error {
+		run := &WorkflowRun{}
+		if err := loadJSON(path, run); err != nil {
+			return err
+		}
+		e.runs[run.Guid] = run
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, run := range e.runs {
+		if run.State == runStateRunning {
+			e.resume(run)
+		}
+	}
+
+	return nil
+}
+
+// resume reconciles a run that was in flight when gamma stopped: tasks that
+// completed in the meantime are processed, and tasks the receptor no longer
+// knows about are submitted again, unless they are still waiting in the
+// admission queue.
+func (e *workflowEngine) resume(run *WorkflowRun) {
+	for _, step := range run.Steps {
+		if step.State == stepStateRunning {
+			e.tasks[step.TaskGuid] = run.Guid
+		}
+	}
+
+	for taskGuid, runGuid := range e.tasks {
+		if runGuid != run.Guid || admission.isQueued(taskGuid) {
+			continue
+		}
+
+		task, err := client.GetTask(taskGuid)
+		if rerr, ok := err.(receptor.Error); ok && rerr.Type == receptor.TaskNotFound {
+			delete(e.tasks, taskGuid)
+			for _, step := range run.Steps {
+				if step.TaskGuid == taskGuid {
+					step.State = stepStatePending
+					step.TaskGuid = ""
+				}
+			}
+			continue
+		}
+		if err != nil {
+			log.Println("failed to look up workflow task:", taskGuid, err)
+			continue
+		}
+
+		if task.State == receptor.TaskStateCompleted {
+			e.complete(run, task)
+		}
+	}
+
+	e.advance(run)
+	if err := e.save(run); err != nil {
+		log.Println("failed to save workflow run:", err)
+	}
+}
+
+func (e *workflowEngine) start(wf Workflow, env []models.EnvironmentVariable) (*WorkflowRun, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	now := time.Now()
+	run := &WorkflowRun{
+		Guid:      uuid.NewUUID().String(),
+		Workflow:  wf,
+		Env:       env,
+		State:     runStateRunning,
+		Steps:     map[string]*StepRun{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	for _, step := range wf.Steps {
+		run.Steps[step.Name] = &StepRun{State: stepStatePending}
+	}
+
+	e.runs[run.Guid] = run
+	e.advance(run)
+
+	return run, e.save(run)
+}
+
+func (e *workflowEngine) taskCompleted(task receptor.TaskResponse) {
+	e.Lock()
+	defer e.Unlock()
+
+	runGuid, ok := e.tasks[task.TaskGuid]
+	if !ok {
+		return
+	}
+	run := e.runs[runGuid]
+
+	e.complete(run, task)
+	e.advance(run)
+	if err := e.save(run); err != nil {
+		log.Println("failed to save workflow run:", err)
+	}
+}
+
+func (e *workflowEngine) complete(run *WorkflowRun, task receptor.TaskResponse) {
+	delete(e.tasks, task.TaskGuid)
+
+	var steps []string
+	for name, step := range run.Steps {
+		if step.TaskGuid == task.TaskGuid && step.State == stepStateRunning {
+			steps = append(steps, name)
+		}
+	}
+
+	if task.Failed {
+		for _, name := range steps {
+			run.Steps[name].State = stepStateFailed
+			run.Steps[name].FailureReason = task.FailureReason
+		}
+		return
+	}
+
+	if len(steps) == 1 {
+		run.Steps[steps[0]].State = stepStateSucceeded
+		run.Steps[steps[0]].Result = resultJSON(task.Result)
+		return
+	}
+
+	outcomes := map[string]stepOutcome{}
+	if err := json.Unmarshal([]byte(task.Result), &outcomes); err != nil {
+		log.Println("failed to decode parallel step results:", err)
+	}
+	for _, name := range steps {
+		outcome, ok := outcomes[name]
+		if !ok || !outcome.Succeeded {
+			run.Steps[name].State = stepStateFailed
+			run.Steps[name].FailureReason = "step failed; see the task's logs"
+			continue
+		}
+		run.Steps[name].State = stepStateSucceeded
+		run.Steps[name].Result = outcome.Result
+	}
+}
+
+// stepOutcome is how a step sharing a task with others finished, as
+// gathered at the end of the task.
+type stepOutcome struct {
+	Succeeded bool            `json:"succeeded"`
+	Result    json.RawMessage `json:"result"`
+}
+
+// advance skips steps whose conditions are not met, submits every step whose
+// dependencies are satisfied, and settles the run once nothing is left to do.
+func (e *workflowEngine) advance(run *WorkflowRun) {
+	run.UpdatedAt = time.Now()
+	if run.State != runStateRunning {
+		return
+	}
+
+	for _, step := range run.Steps {
+		if step.State == stepStateFailed {
+			e.fail(run)
+			return
+		}
+	}
+
+	var ready []WorkflowStep
+	for changed := true; changed; {
+		changed = false
+		ready = nil
+
+		for _, step := range run.Workflow.Steps {
+			if run.Steps[step.Name].State != stepStatePending {
+				continue
+			}
+
+			settled, succeeded := true, 0
+			for _, dep := range step.DependsOn {
+				switch run.Steps[dep].State {
+				case stepStateSucceeded:
+					succeeded++
+				case stepStateSkipped:
+				default:
+					settled = false
+				}
+			}
+			if !settled {
+				continue
+			}
+
+			skip := len(step.DependsOn) > 0 && succeeded == 0
+			if step.When != nil && !step.When.holds(run.Steps[step.When.Step].Result) {
+				skip = true
+			}
+
+			if skip {
+				run.Steps[step.Name].State = stepStateSkipped
+				changed = true
+			} else {
+				ready = append(ready, step)
+			}
+		}
+	}
+
+	if len(ready) > 0 {
+		// A task has a single rootfs and stack, so only steps whose runtimes
+		// share both can run together.
+		groups := map[string][]WorkflowStep{}
+		groupRuntimes := map[string]Runtime{}
+		keys := []string{}
+		for _, step := range ready {
+			runtime := runtimeFor(step.Function)
+			key := runtime.RootFS + " " + runtime.Stack
+			if _, ok := groups[key]; !ok {
+				keys = append(keys, key)
+				groupRuntimes[key] = runtime
+			}
+			groups[key] = append(groups[key], step)
+		}
+
+		for _, key := range keys {
+			if err := e.submit(run, groupRuntimes[key], groups[key]); err != nil {
+				log.Println("failed to submit workflow steps:", err)
+				for _, step := range groups[key] {
+					run.Steps[step.Name].State = stepStateFailed
+					run.Steps[step.Name].FailureReason = err.Error()
+				}
+				e.fail(run)
+				return
+			}
+		}
+		return
+	}
+
+	for _, step := range run.Steps {
+		if step.State == stepStateRunning {
+			return
+		}
+	}
+	run.State = runStateSucceeded
+}
+
+// fail cancels the run's pending steps, and fails the run once none of its
+// steps are still running, so that their tasks are still seen to completion.
+func (e *workflowEngine) fail(run *WorkflowRun) {
+	running := false
+	for _, step := range run.Steps {
+		switch step.State {
+		case stepStatePending:
+			step.State = stepStateCancelled
+		case stepStateRunning:
+			running = true
+		}
+	}
+	if !running {
+		run.State = runStateFailed
+	}
+}
+
+// submit runs the given steps as a single task in runtime's rootfs and stack. Independent steps
+// share the task through a ParallelAction, each in its own directory. Each
+// runs inside a TryAction, so that one failing does not fail the others, and
+// leaves a marker when it succeeds. Their outcomes and results are gathered
+// into one JSON object keyed by step name.
+func (e *workflowEngine) submit(run *WorkflowRun, runtime Runtime, steps []WorkflowStep) error {
+	if err := cells.checkStack(runtime.Stack); err != nil {
+		return err
+	}
+
+	for _, step := range steps {
+		if err := statFunction(step.Function); err != nil {
+			return fmt.Errorf("could not find function: %s", step.Function)
+		}
+		if err := validEntrypoint(step.Function, step.Entry); err != nil {
+			return fmt.Errorf("step %s: %s: %s", step.Name, err, entrypoint(step.Entry))
+		}
+	}
+
+	guid := uuid.NewUUID().String()
+
+	var action models.Action
+	var resultFile string
+	if len(steps) == 1 {
+		var err error
+		if action, err = e.stepAction(guid, run, steps[0]); err != nil {
+			envFiles.revoke(guid)
+			return err
+		}
+		resultFile = stepResultFile(steps[0])
+	} else {
+		actions := make([]models.Action, len(steps))
+		gather := []string{"printf '{'"}
+		for i, step := range steps {
+			stepAction, err := e.stepAction(guid, run, step)
+			if err != nil {
+				envFiles.revoke(guid)
+				return err
+			}
+			marker := stepSucceededFile(step)
+			actions[i] = models.Try(models.Serial(
+				stepAction,
+				&models.RunAction{
+					Path: "/bin/sh",
+					Args: []string{"-c", "mkdir -p " + path.Dir(marker) + " && touch " + marker},
+				},
+			))
+
+			if i > 0 {
+				gather = append(gather, "printf ','")
+			}
+			file := stepResultFile(step)
+			gather = append(gather,
+				fmt.Sprintf(`printf '"%s":{"succeeded":'`, step.Name),
+				fmt.Sprintf("if [ -e %s ]; then printf true; else printf false; fi", marker),
+				`printf ',"result":'`,
+				fmt.Sprintf("if [ -s %s ]; then cat %s; else printf null; fi", file, file),
+				"printf '}'",
+			)
+		}
+		gather = append(gather, "printf '}'")
+
+		resultFile = "/home/vcap/result.json"
+		action = models.Serial(
+			models.Parallel(actions...),
+			&models.RunAction{
+				Path: "/bin/sh",
+				Args: []string{"-c", "{ " + strings.Join(gather, "; ") + "; } > " + resultFile},
+			},
+		)
+	}
+
+	request := newTaskRequest(guid, runtime, taskAnnotation{Workflow: run.Workflow.Name}, action)
+	request.ResultFile = resultFile
+	if _, err := admission.submit("workflow:"+run.Workflow.Name, "", request); err != nil {
+		envFiles.revoke(guid)
+		return err
+	}
+
+	e.tasks[guid] = run.Guid
+	for _, step := range steps {
+		run.Steps[step.Name].State = stepStateRunning
+		run.Steps[step.Name].TaskGuid = guid
+	}
+
+	return nil
+}
+
+func (e *workflowEngine) stepAction(guid string, run *WorkflowRun, step WorkflowStep) (models.Action, error) {
+	secretEnv, envFile, err := secretDelivery(guid, step.Function)
+	if err != nil {
+		return nil, err
+	}
+
+	env := mergeEnv(
+		configs.get(step.Function).Env,
+		run.Env,
+		step.Env,
+		secretEnv,
+		[]models.EnvironmentVariable{{Name: "GAMMA_RESULT_FILE", Value: stepResultFile(step)}},
+	)
+
+	return functionActions(step.Function, entrypoint(step.Entry), stepDir(step), env, envFile), nil
+}
+
+func stepDir(step WorkflowStep) string {
+	return "/home/vcap/steps/" + step.Name
+}
+
+func stepResultFile(step WorkflowStep) string {
+	return stepDir(step) + "/result.json"
+}
+
+// stepSucceededFile is touched once a step sharing a task with others has
+// succeeded. It is kept out of the step's directory, which the step owns.
+func stepSucceededFile(step WorkflowStep) string {
+	return stepDir(step) + ".succeeded"
+}
+
+func resultJSON(result string) json.RawMessage {
+	if result == "" {
+		return nil
+	}
+
+	var v interface{}
+	if json.Unmarshal([]byte(result), &v) == nil {
+		return json.RawMessage(result)
+	}
+
+	quoted, _ := json.Marshal(result)
+	return json.RawMessage(quoted)
+}
+
+func (e *workflowEngine) save(run *WorkflowRun) error {
+	return saveJSON(runPath(run.Guid), run)
+}
+
+func (e *workflowEngine) get(guid string) (WorkflowRun, bool) {
+	e.Lock()
+	defer e.Unlock()
+
+	run, ok := e.runs[guid]
+	if !ok {
+		return WorkflowRun{}, false
+	}
+	return run.snapshot(), true
+}
+
+func (e *workflowEngine) list(workflow string) []WorkflowRun {
+	e.Lock()
+	defer e.Unlock()
+
+	runs := []WorkflowRun{}
+	for _, run := range e.runs {
+		if run.Workflow.Name == workflow {
+			runs = append(runs, run.snapshot())
+		}
+	}
+	sort.Sort(runsByCreation(runs))
+
+	return runs
+}
+
+func (run *WorkflowRun) snapshot() WorkflowRun {
+	copied := *run
+	copied.Steps = map[string]*StepRun{}
+	for name, step := range run.Steps {
+		s := *step
+		copied.Steps[name] = &s
+	}
+	return copied
+}
+
+type runsByCreation []WorkflowRun
+
+func (r runsByCreation) Len() int           { return len(r) }
+func (r runsByCreation) Less(i, j int) bool { return r[i].CreatedAt.Before(r[j].CreatedAt) }
+func (r runsByCreation) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func registerWorkflowHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	var wf Workflow
+	if err := json.NewDecoder(r.Body).Decode(&wf); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wf.Name = name
+
+	if err := wf.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := saveJSON(workflowPath(name), wf); err != nil {
+		log.Println(err)
+		http.Error(w, "could not save workflow", http.StatusInternalServerError)
+		return
+	}
+
+	io.WriteString(w, "registered workflow: "+name)
+}
+
+func getWorkflowHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	http.ServeFile(w, r, workflowPath(name))
+}
+
+func runWorkflowHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	var wf Workflow
+	if err := loadJSON(workflowPath(name), &wf); err != nil {
+		http.Error(w, "could not find workflow", http.StatusNotFound)
+		return
+	}
+
+	var call WorkflowCall
+	if err := json.NewDecoder(r.Body).Decode(&call); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validEnv(call.Env); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	run, err := workflows.start(wf, call.Env)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, FunctionCallResponse{Guid: run.Guid})
+}
+
+func listWorkflowRunsHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+
+	writeJSON(w, workflows.list(name))
+}
+
+func getWorkflowRunHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	guid := r.URL.Query().Get(":guid")
+
+	run, ok := workflows.get(guid)
+	if !ok || run.Workflow.Name != name {
+		http.Error(w, "could not find workflow run", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, run)
+}
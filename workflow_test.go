@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cloudfoundry-incubator/receptor"
+)
+
+func newTestRun(steps []WorkflowStep, states map[string]*StepRun) *WorkflowRun {
+	run := &WorkflowRun{
+		Guid:     "run",
+		Workflow: Workflow{Name: "deploy", Steps: steps},
+		State:    runStateRunning,
+		Steps:    map[string]*StepRun{},
+	}
+	for _, step := range steps {
+		run.Steps[step.Name] = &StepRun{State: stepStatePending}
+		if state, ok := states[step.Name]; ok {
+			run.Steps[step.Name] = state
+		}
+	}
+	return run
+}
+
+func newTestEngine(run *WorkflowRun) *workflowEngine {
+	e := &workflowEngine{
+		runs:  map[string]*WorkflowRun{run.Guid: run},
+		tasks: map[string]string{},
+	}
+	for _, step := range run.Steps {
+		if step.State == stepStateRunning {
+			e.tasks[step.TaskGuid] = run.Guid
+		}
+	}
+	return e
+}
+
+func checkRun(t *testing.T, name string, run *WorkflowRun, state string, steps map[string]string) {
+	if run.State != state {
+		t.Errorf("%s: run is %s, expected %s", name, run.State, state)
+	}
+	for step, expected := range steps {
+		if actual := run.Steps[step].State; actual != expected {
+			t.Errorf("%s: step %s is %s, expected %s", name, step, actual, expected)
+		}
+	}
+}
+
+func TestWorkflowAdvance(t *testing.T) {
+	registerTestFunction(t, "fn")
+
+	a := WorkflowStep{Name: "a", Function: "fn"}
+	b := WorkflowStep{Name: "b", Function: "fn", DependsOn: []string{"a"}}
+	c := WorkflowStep{Name: "c", Function: "fn"}
+	when := b
+	when.When = &StepCondition{Step: "a", Path: "deploy"}
+
+	for _, test := range []struct {
+		name   string
+		steps  []WorkflowStep
+		states map[string]*StepRun
+		state  string
+		expect map[string]string
+		tasks  int
+	}{
+		{
+			name:   "starts the steps without dependencies",
+			steps:  []WorkflowStep{a, b},
+			state:  runStateRunning,
+			expect: map[string]string{"a": stepStateRunning, "b": stepStatePending},
+			tasks:  1,
+		},
+		{
+			name:   "runs independent steps in one task",
+			steps:  []WorkflowStep{a, c},
+			state:  runStateRunning,
+			expect: map[string]string{"a": stepStateRunning, "c": stepStateRunning},
+			tasks:  1,
+		},
+		{
+			name:   "starts a step once its dependency succeeds",
+			steps:  []WorkflowStep{a, b},
+			states: map[string]*StepRun{"a": {State: stepStateSucceeded}},
+			state:  runStateRunning,
+			expect: map[string]string{"b": stepStateRunning},
+			tasks:  1,
+		},
+		{
+			name:   "starts a step whose condition holds",
+			steps:  []WorkflowStep{a, when},
+			states: map[string]*StepRun{"a": {State: stepStateSucceeded, Result: json.RawMessage(`{"deploy": true}`)}},
+			state:  runStateRunning,
+			expect: map[string]string{"b": stepStateRunning},
+			tasks:  1,
+		},
+		{
+			name:   "skips a step whose condition does not hold",
+			steps:  []WorkflowStep{a, when},
+			states: map[string]*StepRun{"a": {State: stepStateSucceeded, Result: json.RawMessage(`{"deploy": false}`)}},
+			state:  runStateSucceeded,
+			expect: map[string]string{"b": stepStateSkipped},
+		},
+		{
+			name:   "skips a step whose dependencies were all skipped",
+			steps:  []WorkflowStep{a, b},
+			states: map[string]*StepRun{"a": {State: stepStateSkipped}},
+			state:  runStateSucceeded,
+			expect: map[string]string{"b": stepStateSkipped},
+		},
+		{
+			name:   "cancels pending steps once a step fails",
+			steps:  []WorkflowStep{a, b, c},
+			states: map[string]*StepRun{"a": {State: stepStateFailed}},
+			state:  runStateFailed,
+			expect: map[string]string{"b": stepStateCancelled, "c": stepStateCancelled},
+		},
+		{
+			name:  "waits for running steps before failing the run",
+			steps: []WorkflowStep{a, b, c},
+			states: map[string]*StepRun{
+				"a": {State: stepStateFailed},
+				"c": {State: stepStateRunning, TaskGuid: "task-c"},
+			},
+			state:  runStateRunning,
+			expect: map[string]string{"b": stepStateCancelled, "c": stepStateRunning},
+		},
+	} {
+		fake := useFakeReceptor()
+		run := newTestRun(test.steps, test.states)
+		newTestEngine(run).advance(run)
+
+		checkRun(t, test.name, run, test.state, test.expect)
+		if created := len(fake.createdGuids()); created != test.tasks {
+			t.Errorf("%s: created %d tasks, expected %d", test.name, created, test.tasks)
+		}
+	}
+}
+
+func TestWorkflowResume(t *testing.T) {
+	registerTestFunction(t, "fn")
+
+	steps := []WorkflowStep{
+		{Name: "a", Function: "fn"},
+		{Name: "b", Function: "fn", DependsOn: []string{"a"}},
+	}
+
+	for _, test := range []struct {
+		name   string
+		task   *receptor.TaskResponse
+		queued bool
+		state  string
+		expect map[string]string
+		// resubmitted is whether step a runs as a new task.
+		resubmitted bool
+		tasks       int
+	}{
+		{
+			name:   "leaves a task that is still running",
+			task:   &receptor.TaskResponse{TaskGuid: "task-a", State: receptor.TaskStateRunning},
+			state:  runStateRunning,
+			expect: map[string]string{"a": stepStateRunning, "b": stepStatePending},
+		},
+		{
+			name:   "leaves a task waiting in the admission queue",
+			queued: true,
+			state:  runStateRunning,
+			expect: map[string]string{"a": stepStateRunning, "b": stepStatePending},
+		},
+		{
+			name:        "resubmits a task the receptor lost",
+			state:       runStateRunning,
+			expect:      map[string]string{"a": stepStateRunning, "b": stepStatePending},
+			resubmitted: true,
+			tasks:       1,
+		},
+		{
+			name:   "advances past a task that succeeded meanwhile",
+			task:   &receptor.TaskResponse{TaskGuid: "task-a", State: receptor.TaskStateCompleted, Result: `{"ok": true}`},
+			state:  runStateRunning,
+			expect: map[string]string{"a": stepStateSucceeded, "b": stepStateRunning},
+			tasks:  1,
+		},
+		{
+			name:   "fails the run for a task that failed meanwhile",
+			task:   &receptor.TaskResponse{TaskGuid: "task-a", State: receptor.TaskStateCompleted, Failed: true},
+			state:  runStateFailed,
+			expect: map[string]string{"a": stepStateFailed, "b": stepStateCancelled},
+		},
+	} {
+		fake := useFakeReceptor()
+		if test.task != nil {
+			fake.tasks[test.task.TaskGuid] = *test.task
+		}
+		if test.queued {
+			admission.queue = admissionQueue{{
+				Function: "workflow:deploy",
+				Request:  receptor.TaskCreateRequest{TaskGuid: "task-a"},
+			}}
+		}
+
+		run := newTestRun(steps, map[string]*StepRun{
+			"a": {State: stepStateRunning, TaskGuid: "task-a"},
+		})
+		e := &workflowEngine{runs: map[string]*WorkflowRun{run.Guid: run}, tasks: map[string]string{}}
+		e.resume(run)
+
+		checkRun(t, test.name, run, test.state, test.expect)
+		if resubmitted := run.Steps["a"].TaskGuid != "task-a"; resubmitted != test.resubmitted {
+			t.Errorf("%s: step a runs as %s", test.name, run.Steps["a"].TaskGuid)
+		}
+		if created := len(fake.createdGuids()); created != test.tasks {
+			t.Errorf("%s: created %d tasks, expected %d", test.name, created, test.tasks)
+		}
+	}
+}